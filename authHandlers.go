@@ -1,14 +1,23 @@
 package main
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
 	"net/http"
-	"time"
+	urlp "net/url"
 
+	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
 	"go.uber.org/zap"
 )
 
+func newSessionClient(r *http.Request) SessionClient {
+	return SessionClient{
+		UserAgent: r.UserAgent(),
+		IPAddress: clientIP(r),
+	}
+}
+
 func callbackHandler(w http.ResponseWriter, r *http.Request) {
 	user, err := gothic.CompleteUserAuth(w, r)
 	if err != nil {
@@ -23,29 +32,176 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newUser, err := SyncUserProvider(user)
+	callbackQueryParams := r.URL.Query()
+	stateFromCallback := callbackQueryParams.Get("state")
+
+	sessionData, err := gLoginStates.Take(stateFromCallback)
+	if err != nil {
+		logger.Error("Callback session state not found or expired.", zap.String("state", stateFromCallback), zap.Error(err))
+		http.Error(w, "Authentication session expired or invalid.", http.StatusUnauthorized)
+		return
+	}
+
+	// The client registration may have changed while the user was signing in.
+	// Device approvals answer on this page and never redirect to the client.
+	client, err := GetClient(sessionData.ClientID)
+	if err == nil && sessionData.Delivery != DeviceDelivery {
+		_, err = client.ValidateRedirectURI(sessionData.RedirectURL)
+	}
 	if err != nil {
+		logger.Warn("Login state redirect no longer allowed for client.",
+			zap.String("client_id", sessionData.ClientID), zap.String("redirect_uri", sessionData.RedirectURL), zap.Error(err))
+		http.Error(w, "Unauthorized redirect_uri.", http.StatusBadRequest)
+		return
+	}
+
+	if sessionData.LinkUserID != nil {
+		completeIdentityLink(w, r, user, sessionData)
+		return
+	}
+
+	newUser, err := SyncUserProvider(user)
+	if errors.Is(err, ErrProviderNotSupported) {
+		logger.Warn("Provider without user mapper", zap.String("provider", user.Provider), zap.Error(err))
+		http.Error(w, "Provider not supported.", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, ErrMissingRequiredClaim) {
+		logger.Warn("Provider profile missing required claim", zap.String("provider", user.Provider), zap.Error(err))
+		http.Error(w, "Provider profile is incomplete.", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, ErrNicknameTaken) {
+		logger.Warn("Nickname already taken", zap.String("provider", user.Provider), zap.Error(err))
+		http.Error(w, "Nickname is already taken; change it at the provider and sign in again.", http.StatusConflict)
+		return
+	} else if err != nil {
 		http.Error(w, "Error on Create account.", http.StatusInternalServerError)
 		return
 	}
 
-	callbackQueryParams := r.URL.Query()
-	stateFromCallback := callbackQueryParams.Get("state")
+	if sessionData.Delivery == DeviceDelivery {
+		completeDeviceApproval(w, newUser, sessionData)
+		return
+	}
 
-	gClientsSessions.Lock()
-	sessionData, found := gClientsSessions.data[stateFromCallback]
-	if !found || time.Now().After(sessionData.ExpiresAt) {
-		gClientsSessions.Unlock()
-		logger.Error("Callback session state not found or expired.", zap.String("state", stateFromCallback))
-		http.Error(w, "Authentication session expired or invalid.", http.StatusUnauthorized)
+	if sessionData.Delivery == CookieDelivery {
+		tokens, err := StartLoginSession(newUser, newSessionClient(r))
+		if err == nil {
+			err = setTokenCookies(w, tokens)
+		}
+		if err != nil {
+			logger.Error("Error on start login session", zap.Error(err))
+			http.Error(w, "Error on Create account.", http.StatusInternalServerError)
+			return
+		}
+
+		redirectURL := buildClientRedirect(sessionData.RedirectURL, urlp.Values{
+			"return_to": {sessionData.ReturnTo},
+		})
+
+		logger.Info("Redirect to", zap.String("redirectURL", sessionData.RedirectURL))
+		http.Redirect(w, r, redirectURL, http.StatusFound)
 		return
 	}
-	delete(gClientsSessions.data, stateFromCallback)
-	gClientsSessions.Unlock()
 
-	redirectURL := fmt.Sprintf("%shome?access_token=%s&refresh_token=%s",
-		sessionData.RedirectURL, *newUser.AccessToken, *newUser.RefreshToken)
+	code, err := CreateLoginCode(newUser, sessionData)
+	if err != nil {
+		logger.Error("Error on create login code", zap.Error(err))
+		http.Error(w, "Error on Create account.", http.StatusInternalServerError)
+		return
+	}
+
+	params := urlp.Values{
+		"code":      {code},
+		"return_to": {sessionData.ReturnTo},
+	}
+	if sessionData.Delivery == OAuthDelivery {
+		params = urlp.Values{"code": {code}, "state": {sessionData.ClientState}}
+	}
+	redirectURL := buildClientRedirect(sessionData.RedirectURL, params)
 
 	logger.Info("Redirect to", zap.String("redirectURL", sessionData.RedirectURL))
 	http.Redirect(w, r, redirectURL, http.StatusFound)
 }
+
+// completeIdentityLink finishes a link started from POST /identities/{provider}
+// and sends the browser back to the client with the outcome.
+func completeIdentityLink(w http.ResponseWriter, r *http.Request, user goth.User, sessionData LoginState) {
+	params := urlp.Values{
+		"linked":    {user.Provider},
+		"return_to": {sessionData.ReturnTo},
+	}
+
+	_, err := LinkIdentity(*sessionData.LinkUserID, user)
+	if errors.Is(err, ErrIdentityAlreadyLinked) {
+		logger.Warn("Identity already linked to another account", zap.String("provider", user.Provider))
+		params = urlp.Values{"error": {"identity_already_linked"}, "return_to": {sessionData.ReturnTo}}
+	} else if errors.Is(err, ErrProviderNotSupported) || errors.Is(err, ErrMissingRequiredClaim) {
+		logger.Warn("Provider profile cannot be linked", zap.String("provider", user.Provider), zap.Error(err))
+		params = urlp.Values{"error": {"identity_not_supported"}, "return_to": {sessionData.ReturnTo}}
+	} else if err != nil {
+		logger.Error("Error on link identity", zap.Error(err))
+		http.Error(w, "Error on link account.", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, buildClientRedirect(sessionData.RedirectURL, params), http.StatusFound)
+}
+
+type CodeExchangeRequest struct {
+	Code         string `json:"code"`
+	CodeVerifier string `json:"code_verifier"`
+}
+
+func postExchangeCode(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "postExchangeCode"
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	var request CodeExchangeRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		logger.Warn("Error on Convert Body", zap.String("method", method), zap.Error(err))
+		http.Error(w, "Erro ao decodificar JSON", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	response, err := ExchangeLoginCode(request.Code, request.CodeVerifier, newSessionClient(r))
+	if errors.Is(err, ErrInvalidAuthorizationCode) || errors.Is(err, ErrInvalidCodeVerifier) {
+		logger.Warn("Invalid code exchange", zap.String("method", method), zap.Error(err))
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		logger.Error("Error on code exchange", zap.String("method", method), zap.Error(err))
+		http.Error(w, "Erro ao gerar tokens", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func getJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(PublicKeySet())
+}
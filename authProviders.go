@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"sort"
 
 	"github.com/markbates/goth"
@@ -13,14 +14,12 @@ type ProviderIndex struct {
 	ProvidersMap map[string]string
 }
 
-var UserAccount = map[string]func(goth.User) User{
-	"github": NewGithubUser,
-}
+var ErrProviderNotSupported = errors.New("no user mapper registered for provider")
 
 func initProviders() *ProviderIndex {
 	goth.UseProviders(
 		github.New(environments.Auths.ProviderKeys["github"], environments.Auths.ProviderSecrets["github"], environments.RedirectUrl+"/api/v1/guardian/auth/github/callback"),
-		google.New(environments.Auths.ProviderKeys["google"], environments.Auths.ProviderSecrets["google"], environments.RedirectUrl+"/api/v1/guardian/auth/google/callback"),
+		google.New(environments.Auths.ProviderKeys["google"], environments.Auths.ProviderSecrets["google"], environments.RedirectUrl+"/api/v1/guardian/auth/google/callback", "openid", "email", "profile"),
 	)
 
 	m := map[string]string{
@@ -28,6 +27,9 @@ func initProviders() *ProviderIndex {
 		"google": "Google",
 	}
 
+	goth.UseProviders(initOIDCProviders(m)...)
+	initClaimMappings()
+
 	var keys []string
 	for k := range m {
 		keys = append(keys, k)
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"time"
 
 	"github.com/markbates/goth"
+	"go.uber.org/zap"
 )
 
 var (
@@ -19,72 +24,384 @@ var (
 	ErrRefreshTokenExpired       = errors.New("refresh token has expired") // From jwt_utils.ValidateToken
 	ErrAuthenticationFailed      = errors.New("authentication failed")     // General auth error
 	ErrUnexpectedTokenValidation = errors.New("unexpected token validation error")
+	ErrRefreshTokenReused        = errors.New("refresh token reuse detected")
+	ErrSessionNotFound           = errors.New("session associated with token not found")
+	ErrInvalidAuthorizationCode  = errors.New("authorization code is invalid, expired or already used")
+	ErrInvalidCodeVerifier       = errors.New("code verifier does not match the code challenge")
+	ErrNicknameTaken             = errors.New("nickname is already taken")
 )
 
+// nicknameAttempts bounds how many suffixed nicknames a new account tries
+// when the one from the provider profile is taken.
+const nicknameAttempts = 5
+
 func SyncUserProvider(user goth.User) (User, error) {
-	newUser := UserAccount[user.Provider](user)
-	err := CreateUserOrUpdateProviderTokens(newUser)
+	newUser, err := mapProviderUser(user)
 	if err != nil {
 		return User{}, err
 	}
 
-	newUser, err = GetUserByProviderId(newUser.ProviderUserID)
-	if err != nil {
+	identity := newIdentity(newUser)
+	existing, err := GetUserByIdentity(identity.Provider, identity.ProviderUserID)
+	if err == nil {
+		return existing, UpdateIdentityProviderTokens(identity)
+	} else if !errors.Is(err, sql.ErrNoRows) {
 		return User{}, err
 	}
 
-	token, refresh, _ := GenerateTokens(newUser)
-	err = UpdateUserTokens(token, refresh, newUser.ID)
-	if err != nil {
+	nickname := newUser.NickName
+	for attempt := 1; ; attempt++ {
+		err = CreateUserWithIdentity(newUser, identity)
+		if !isNicknameTaken(err) {
+			break
+		}
+		if attempt == nicknameAttempts {
+			return User{}, fmt.Errorf("%w: %s", ErrNicknameTaken, nickname)
+		}
+
+		newUser.NickName, err = suffixedNickname(nickname)
+		if err != nil {
+			return User{}, err
+		}
+	}
+	if err != nil && !isUniqueViolation(err) {
 		return User{}, err
 	}
-	newUser.AccessToken = &token
-	newUser.RefreshToken = &refresh
 
-	return newUser, nil
+	return GetUserByIdentity(identity.Provider, identity.ProviderUserID)
+}
+
+// suffixedNickname makes a nickname that is taken likely unique, e.g.
+// "octocat" becomes "octocat-3f9a".
+func suffixedNickname(nickname string) (string, error) {
+	suffix := make([]byte, 2)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return nickname + "-" + hex.EncodeToString(suffix), nil
+}
+
+// CreateLoginCode issues a short-lived, single-use code that the browser which
+// started the login trades for tokens by proving it holds the PKCE verifier.
+// The code stays bound to the client, redirect URI and delivery of that login.
+func CreateLoginCode(user User, login LoginState) (string, error) {
+	code, err := generateAuthorizationCode()
+	if err != nil {
+		return "", err
+	}
+
+	err = CreateAuthorizationCode(hashAuthorizationCode(code), AuthorizationCode{
+		UserID:        user.ID,
+		ClientID:      login.ClientID,
+		RedirectURI:   login.RedirectURL,
+		Scope:         login.Scope,
+		Nonce:         login.Nonce,
+		CodeChallenge: login.CodeChallenge,
+		Delivery:      login.Delivery,
+		ExpiresAt:     time.Now().Add(AuthorizationCodeLifetime),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// redeemAuthorizationCode consumes the code and checks the PKCE verifier and,
+// through issuedTo, the flow the code was issued for. A code is spent even
+// when it is presented to the wrong flow.
+func redeemAuthorizationCode(code, codeVerifier string, issuedTo func(AuthorizationCode) bool) (AuthorizationCode, User, error) {
+	authCode, err := ConsumeAuthorizationCode(hashAuthorizationCode(code))
+	if err == sql.ErrNoRows {
+		return AuthorizationCode{}, User{}, ErrInvalidAuthorizationCode
+	} else if err != nil {
+		return AuthorizationCode{}, User{}, fmt.Errorf("%w: %v", ErrUnexpectedTokenValidation, err)
+	}
+
+	if !verifyCodeChallenge(codeVerifier, authCode.CodeChallenge) {
+		return AuthorizationCode{}, User{}, ErrInvalidCodeVerifier
+	}
+
+	if !issuedTo(authCode) {
+		return AuthorizationCode{}, User{}, ErrInvalidAuthorizationCode
+	}
+
+	user, err := GetUserByUserId(authCode.UserID)
+	if err != nil {
+		return AuthorizationCode{}, User{}, fmt.Errorf("%w: %v", ErrUserNotFound, err)
+	}
+
+	return authCode, user, nil
+}
+
+// ExchangeLoginCode redeems a first-party login code. Codes issued to OAuth
+// clients are rejected, so they cannot be upgraded into first-party sessions.
+func ExchangeLoginCode(code, codeVerifier string, client SessionClient) (UserTokenResponse, error) {
+	_, user, err := redeemAuthorizationCode(code, codeVerifier, func(authCode AuthorizationCode) bool {
+		_, configured := gClients[authCode.ClientID]
+		return configured && authCode.Delivery == CodeDelivery
+	})
+	if err != nil {
+		return UserTokenResponse{}, err
+	}
+
+	return StartLoginSession(user, client)
 }
 
-func RenewAccessToken(oldAccess, oldRefresh string) (UserTokenResponse, error) {
+func StartLoginSession(user User, client SessionClient) (UserTokenResponse, error) {
+	_, pair, err := StartSession(user, client)
+	if err != nil {
+		return UserTokenResponse{}, err
+	}
+
+	return UserTokenResponse{
+		AccessToken:  pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+	}, nil
+}
+
+func StartSession(user User, client SessionClient) (Session, TokenPair, error) {
+	session := Session{
+		ID:        uuid.New(),
+		UserID:    user.ID,
+		ClientID:  client.ClientID,
+		Scope:     client.Scope,
+		UserAgent: client.UserAgent,
+		IPAddress: client.IPAddress,
+	}
+
+	pair, err := issueTokens(user, session, nil)
+	if err != nil {
+		return Session{}, TokenPair{}, err
+	}
+	session.FamilyID = pair.FamilyID
+	session.setTokenHashes(pair)
+
+	err = CreateSession(session)
+	if err != nil {
+		return Session{}, TokenPair{}, fmt.Errorf("%w: %v", ErrTokenUpdateFailure, err)
+	}
+
+	return session, pair, nil
+}
+
+// ReissueSessionTokens gives the session a fresh token family, for when the
+// claims carried by its current tokens are no longer accurate.
+func ReissueSessionTokens(user User, session Session) (TokenPair, error) {
+	previousFamilyID := session.FamilyID
+	session.FamilyID = ""
+
+	pair, err := issueTokens(user, session, nil)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	session.FamilyID = pair.FamilyID
+	session.setTokenHashes(pair)
+
+	err = UpdateSessionTokens(session)
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("%w: %v", ErrTokenUpdateFailure, err)
+	}
+
+	err = RevokeRefreshTokenFamily(previousFamilyID, "superseded")
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("%w: %v", ErrTokenUpdateFailure, err)
+	}
+
+	return pair, nil
+}
+
+func RegisterUser(user User, session Session) (UserTokenResponse, error) {
+	err := UpdateUserRegister(user)
+	if err != nil {
+		return UserTokenResponse{}, err
+	}
+
+	pair, err := ReissueSessionTokens(user, session)
+	if err != nil {
+		return UserTokenResponse{}, err
+	}
+
+	return UserTokenResponse{
+		AccessToken:  pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+	}, nil
+}
+
+func issueTokens(user User, session Session, parentJTI *string) (TokenPair, error) {
+	pair, err := GenerateTokens(user, session, tokenLifetimesFor(session.ClientID))
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("%w: %v", ErrTokenGenerationFailure, err)
+	}
+
+	err = CreateRefreshToken(pair, parentJTI, user.ID)
+	if err != nil {
+		return TokenPair{}, fmt.Errorf("%w: %v", ErrTokenUpdateFailure, err)
+	}
+
+	return pair, nil
+}
+
+// checkRefreshTokenFamily rejects refresh tokens whose family was revoked and
+// revokes the whole family when an already rotated token is presented again.
+func checkRefreshTokenFamily(jti string, user User) error {
+	state, err := GetRefreshTokenState(jti)
+	if err == sql.ErrNoRows {
+		return ErrInvalidRefreshToken
+	} else if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnexpectedTokenValidation, err)
+	}
+
+	if state.UserID != user.ID {
+		return ErrRefreshTokenMismatch
+	}
+
+	if state.RevokedAt != nil {
+		return ErrTokenHasBeenRevokedOrUsed
+	}
+
+	if state.RotatedAt != nil {
+		return revokeReusedFamily(state.FamilyID, jti, user)
+	}
+
+	return nil
+}
+
+func revokeReusedFamily(familyID, jti string, user User) error {
+	emitSecurityEvent(RefreshTokenReuseDetected,
+		zap.String("user_id", user.ID.String()),
+		zap.String("family_id", familyID),
+		zap.String("jti", jti))
+
+	if err := RevokeRefreshTokenFamily(familyID, RefreshTokenReuseDetected); err != nil {
+		return fmt.Errorf("%w: %v", ErrTokenUpdateFailure, err)
+	}
+
+	return ErrRefreshTokenReused
+}
+
+func RenewAccessToken(oldAccess, oldRefresh string, client SessionClient) (UserTokenResponse, error) {
+	_, pair, err := renewSessionTokens(oldRefresh, &oldAccess, client)
+	if err != nil {
+		return UserTokenResponse{}, err
+	}
+
+	return UserTokenResponse{
+		AccessToken:  pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+	}, nil
+}
+
+// renewSessionTokens rotates the refresh token of a session. First-party
+// callers also present the access token, which must be the session's current
+// one; OAuth clients are matched on the client that owns the session instead.
+func renewSessionTokens(oldRefresh string, oldAccess *string, client SessionClient) (Session, TokenPair, error) {
 	claims, err := ValidateToken(oldRefresh, Refresh)
 	if err != nil {
-		return UserTokenResponse{}, fmt.Errorf("%w: %v", ErrInvalidRefreshToken, err)
+		return Session{}, TokenPair{}, fmt.Errorf("%w: %v", ErrInvalidRefreshToken, err)
 	}
 
 	userID, ok := (*claims)["sub"].(string)
 	if !ok || userID == "" {
-		return UserTokenResponse{}, fmt.Errorf("%w: user ID (sub) not found in refresh token claims", ErrInvalidRefreshToken)
+		return Session{}, TokenPair{}, fmt.Errorf("%w: user ID (sub) not found in refresh token claims", ErrInvalidRefreshToken)
 	}
 
 	userUUID, err := uuid.Parse(userID)
 	if err != nil {
-		return UserTokenResponse{}, fmt.Errorf("%w: invalid user ID format from token: %v", ErrInvalidRefreshToken, err)
+		return Session{}, TokenPair{}, fmt.Errorf("%w: invalid user ID format from token: %v", ErrInvalidRefreshToken, err)
 	}
 
 	user, err := GetUserByUserId(userUUID)
 	if err != nil {
-		return UserTokenResponse{}, fmt.Errorf("%w: %v", ErrUserNotFound, err)
+		return Session{}, TokenPair{}, fmt.Errorf("%w: %v", ErrUserNotFound, err)
 	}
 
-	if user.RefreshToken == nil || *user.RefreshToken != oldRefresh {
-		return UserTokenResponse{}, ErrRefreshTokenMismatch
+	jti, _ := (*claims)["jti"].(string)
+	familyID, _ := (*claims)["fam"].(string)
+	sessionID, _ := (*claims)["sid"].(string)
+
+	if sessionID == "" {
+		if oldAccess == nil {
+			return Session{}, TokenPair{}, fmt.Errorf("%w: token is not bound to a session", ErrInvalidRefreshToken)
+		}
+		return renewLegacyTokens(user, *oldAccess, oldRefresh, familyID, client)
 	}
 
-	if user.AccessToken == nil || *user.AccessToken != oldAccess {
-		return UserTokenResponse{}, ErrAccessTokenMismatch
+	sessionUUID, err := uuid.Parse(sessionID)
+	if err != nil {
+		return Session{}, TokenPair{}, fmt.Errorf("%w: invalid session ID format from token: %v", ErrInvalidRefreshToken, err)
 	}
 
-	access, refresh, err := GenerateTokens(user)
+	session, err := GetSessionById(sessionUUID)
 	if err != nil {
-		return UserTokenResponse{}, fmt.Errorf("%w: %v", ErrTokenGenerationFailure, err)
+		return Session{}, TokenPair{}, fmt.Errorf("%w: %v", ErrSessionNotFound, err)
+	}
+
+	if session.UserID != user.ID {
+		return Session{}, TokenPair{}, ErrRefreshTokenMismatch
+	}
+
+	if err := checkRefreshTokenFamily(jti, user); err != nil {
+		return Session{}, TokenPair{}, err
+	}
+
+	if session.RevokedAt != nil || session.FamilyID != familyID {
+		return Session{}, TokenPair{}, ErrTokenHasBeenRevokedOrUsed
 	}
 
-	err = UpdateUserTokens(access, refresh, user.ID)
+	if oldAccess != nil && !matchesTokenHash(session.AccessTokenHash, *oldAccess) {
+		return Session{}, TokenPair{}, ErrAccessTokenMismatch
+	}
+
+	if oldAccess == nil && session.ClientID != client.ClientID {
+		return Session{}, TokenPair{}, ErrRefreshTokenMismatch
+	}
+
+	rotated, err := MarkRefreshTokenRotated(jti)
 	if err != nil {
-		return UserTokenResponse{}, fmt.Errorf("%w: %v", ErrTokenUpdateFailure, err)
+		return Session{}, TokenPair{}, fmt.Errorf("%w: %v", ErrTokenUpdateFailure, err)
+	}
+	if !rotated {
+		// Lost a race against another presentation of the same token.
+		return Session{}, TokenPair{}, revokeReusedFamily(familyID, jti, user)
 	}
 
-	return UserTokenResponse{
-		AccessToken:  access,
-		RefreshToken: refresh,
-	}, nil
+	pair, err := issueTokens(user, session, &jti)
+	if err != nil {
+		return Session{}, TokenPair{}, err
+	}
+	session.setTokenHashes(pair)
+
+	err = UpdateSessionTokens(session)
+	if err != nil {
+		return Session{}, TokenPair{}, fmt.Errorf("%w: %v", ErrTokenUpdateFailure, err)
+	}
+
+	return session, pair, nil
+}
+
+// renewLegacyTokens moves tokens issued before sessions existed, which were
+// only tracked on the users row, into a new session.
+func renewLegacyTokens(user User, oldAccess, oldRefresh, familyID string, client SessionClient) (Session, TokenPair, error) {
+	if !matchesTokenHash(user.RefreshTokenHash, oldRefresh) {
+		return Session{}, TokenPair{}, ErrRefreshTokenMismatch
+	}
+
+	if !matchesTokenHash(user.AccessTokenHash, oldAccess) {
+		return Session{}, TokenPair{}, ErrAccessTokenMismatch
+	}
+
+	err := ClearUserTokens(user.ID)
+	if err != nil {
+		return Session{}, TokenPair{}, fmt.Errorf("%w: %v", ErrTokenUpdateFailure, err)
+	}
+
+	if familyID != "" {
+		err = RevokeRefreshTokenFamily(familyID, "migrated_to_session")
+		if err != nil {
+			return Session{}, TokenPair{}, fmt.Errorf("%w: %v", ErrTokenUpdateFailure, err)
+		}
+	}
+
+	return StartSession(user, client)
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// The verifier and S256 challenge from RFC 7636, Appendix B.
+const (
+	testCodeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+// withMockDB points the package database at a sqlmock connection for the
+// duration of the test and checks every expectation was met.
+func withMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("open sqlmock: %v", err)
+	}
+
+	previousDB, previousLogger := db, logger
+	db, logger = mockDB, zap.NewNop()
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet database expectations: %v", err)
+		}
+		db, logger = previousDB, previousLogger
+		mockDB.Close()
+	})
+	return mock
+}
+
+func expectConsumedCode(mock sqlmock.Sqlmock, code AuthorizationCode) {
+	mock.ExpectQuery("UPDATE authorization_codes").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "client_id", "redirect_uri", "scope", "nonce", "code_challenge", "delivery", "expires_at"}).
+			AddRow(code.UserID, code.ClientID, code.RedirectURI, code.Scope, code.Nonce, code.CodeChallenge, code.Delivery, code.ExpiresAt))
+}
+
+func TestAuthorizationCodeIsBoundToItsFlow(t *testing.T) {
+	previousClients := gClients
+	gClients = map[string]*Client{"web": {ID: "web"}}
+	t.Cleanup(func() { gClients = previousClients })
+
+	issued := func(clientID, redirectURI string, delivery TokenDelivery) AuthorizationCode {
+		return AuthorizationCode{
+			UserID:        uuid.New(),
+			ClientID:      clientID,
+			RedirectURI:   redirectURI,
+			Scope:         "openid",
+			CodeChallenge: testCodeChallenge,
+			Delivery:      delivery,
+			ExpiresAt:     time.Now().Add(time.Minute),
+		}
+	}
+
+	tests := []struct {
+		name   string
+		code   AuthorizationCode
+		redeem func() error
+	}{
+		{
+			name: "oauth code on login exchange",
+			code: issued("web", "https://app.example.com/callback", OAuthDelivery),
+			redeem: func() error {
+				_, err := ExchangeLoginCode("code", testCodeVerifier, SessionClient{})
+				return err
+			},
+		},
+		{
+			name: "registered client code on login exchange",
+			code: issued("partner", "https://partner.example.com/callback", CodeDelivery),
+			redeem: func() error {
+				_, err := ExchangeLoginCode("code", testCodeVerifier, SessionClient{})
+				return err
+			},
+		},
+		{
+			name: "login code on client exchange",
+			code: issued("web", "https://app.example.com/callback", CodeDelivery),
+			redeem: func() error {
+				_, err := ExchangeClientCode("code", testCodeVerifier, "https://app.example.com/callback", SessionClient{ClientID: "web"})
+				return err
+			},
+		},
+		{
+			name: "code issued to another client",
+			code: issued("partner", "https://app.example.com/callback", OAuthDelivery),
+			redeem: func() error {
+				_, err := ExchangeClientCode("code", testCodeVerifier, "https://app.example.com/callback", SessionClient{ClientID: "web"})
+				return err
+			},
+		},
+		{
+			name: "code issued for another redirect uri",
+			code: issued("web", "https://app.example.com/callback", OAuthDelivery),
+			redeem: func() error {
+				_, err := ExchangeClientCode("code", testCodeVerifier, "https://app.example.com/other", SessionClient{ClientID: "web"})
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := withMockDB(t)
+			expectConsumedCode(mock, tt.code)
+
+			if err := tt.redeem(); !errors.Is(err, ErrInvalidAuthorizationCode) {
+				t.Fatalf("expected ErrInvalidAuthorizationCode, got %v", err)
+			}
+		})
+	}
+}
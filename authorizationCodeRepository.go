@@ -0,0 +1,61 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type AuthorizationCode struct {
+	UserID        uuid.UUID
+	ClientID      string
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	Delivery      TokenDelivery
+	ExpiresAt     time.Time
+}
+
+func CreateAuthorizationCode(codeHash string, code AuthorizationCode) error {
+	_, err := db.Exec(`
+		INSERT INTO authorization_codes (code_hash, user_id, client_id,
+			redirect_uri, scope, nonce, code_challenge, delivery, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		codeHash, code.UserID, code.ClientID,
+		code.RedirectURI, code.Scope, code.Nonce, code.CodeChallenge, code.Delivery, code.ExpiresAt)
+
+	if err != nil {
+		logger.Error("Error on create authorization code", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// ConsumeAuthorizationCode marks the code as used and returns it, so a code
+// can be redeemed at most once even across replicas.
+func ConsumeAuthorizationCode(codeHash string) (AuthorizationCode, error) {
+	var code AuthorizationCode
+
+	err := db.QueryRow(`
+	UPDATE authorization_codes SET
+		used_at = NOW()
+	WHERE code_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+	RETURNING user_id, client_id, redirect_uri, scope, nonce, code_challenge, delivery, expires_at`,
+		codeHash).Scan(&code.UserID, &code.ClientID, &code.RedirectURI, &code.Scope, &code.Nonce, &code.CodeChallenge,
+		&code.Delivery, &code.ExpiresAt)
+
+	return code, err
+}
+
+// DeleteSpentAuthorizationCodes drops codes that were redeemed or expired;
+// neither can be exchanged again.
+func DeleteSpentAuthorizationCodes() (int64, error) {
+	result, err := db.Exec(`DELETE FROM authorization_codes WHERE used_at IS NOT NULL OR expires_at <= $1`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
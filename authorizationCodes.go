@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"regexp"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const AuthorizationCodeLifetime = time.Minute
+
+// RFC 7636: verifiers are 43-128 unreserved characters, and a S256 challenge
+// is the unpadded base64url SHA-256 of the verifier.
+var codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+var codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9\-_]{43}$`)
+
+func initAuthorizationCodes() {
+	go cleanupAuthorizationCodes()
+}
+
+func cleanupAuthorizationCodes() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		deleted, err := DeleteSpentAuthorizationCodes()
+		if err != nil {
+			logger.Error("Error on clean up authorization codes", zap.Error(err))
+			continue
+		}
+		logger.Debug("Cleaned up authorization codes.", zap.Int64("deleted", deleted))
+	}
+}
+
+func isValidCodeChallenge(challenge string) bool {
+	return codeChallengePattern.MatchString(challenge)
+}
+
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if !codeVerifierPattern.MatchString(verifier) {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func generateAuthorizationCode() (string, error) {
+	code := make([]byte, 32)
+	if _, err := rand.Read(code); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(code), nil
+}
+
+// hashAuthorizationCode keeps raw codes out of the database.
+func hashAuthorizationCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
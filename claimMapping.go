@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/markbates/goth"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrMissingRequiredClaim = errors.New("required claim missing from provider profile")
+	ErrInvalidClaimMapping  = errors.New("invalid claim mapping")
+)
+
+const (
+	NicknameField      = "nickname"
+	EmailField         = "email"
+	EmailVerifiedField = "email_verified"
+	PictureField       = "picture"
+)
+
+// Sources starting with "user." read the normalized goth.User fields; any
+// other source is a key of the provider's RawData.
+var gothUserSources = map[string]func(goth.User) string{
+	"user.nickname":   func(u goth.User) string { return u.NickName },
+	"user.name":       func(u goth.User) string { return u.Name },
+	"user.email":      func(u goth.User) string { return u.Email },
+	"user.avatar_url": func(u goth.User) string { return u.AvatarURL },
+}
+
+var claimTransforms = map[string]func(value, arg string) string{
+	"trim":         func(value, _ string) string { return strings.TrimSpace(value) },
+	"lowercase":    func(value, _ string) string { return strings.ToLower(value) },
+	"uppercase":    func(value, _ string) string { return strings.ToUpper(value) },
+	"prefix":       func(value, arg string) string { return arg + value },
+	"strip_domain": func(value, _ string) string { before, _, _ := strings.Cut(value, "@"); return before },
+}
+
+// ClaimRule fills one User field from the first non-empty source, applying
+// transforms in order. Transforms with an argument are written "prefix:gh_".
+type ClaimRule struct {
+	From       []string `json:"from"`
+	Transforms []string `json:"transforms,omitempty"`
+	Required   bool     `json:"required,omitempty"`
+}
+
+// ClaimMapping holds the rules of one provider, keyed by User field.
+type ClaimMapping map[string]ClaimRule
+
+var UserAccount = map[string]ClaimMapping{
+	"github": {
+		NicknameField: {From: []string{"user.nickname", "login", "twitter_username"}, Transforms: []string{"trim"}, Required: true},
+		EmailField:    {From: []string{"user.email", "login"}},
+		PictureField:  {From: []string{"user.avatar_url", "avatar_url"}},
+	},
+	"google": {
+		NicknameField:      {From: []string{"user.nickname", "name", "given_name", "email"}, Transforms: []string{"trim", "strip_domain"}, Required: true},
+		EmailField:         {From: []string{"user.email"}},
+		EmailVerifiedField: {From: []string{"verified_email", "email_verified"}},
+		PictureField:       {From: []string{"user.avatar_url", "picture"}},
+	},
+}
+
+// initClaimMappings overrides provider mappings with PROVIDER_MAPPINGS_FILE,
+// a JSON object of provider name to ClaimMapping.
+func initClaimMappings() {
+	path := environments.ProviderMappingsFile
+	if path == "" {
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		logger.Fatal("Setup Project Error | Could not read provider mappings", zap.Error(err))
+	}
+
+	var mappings map[string]ClaimMapping
+	if err := json.Unmarshal(content, &mappings); err != nil {
+		logger.Fatal("Setup Project Error | Invalid provider mappings", zap.Error(err))
+	}
+
+	for provider, mapping := range mappings {
+		if err := mapping.Validate(); err != nil {
+			logger.Fatal("Setup Project Error | Invalid provider mappings", zap.String("provider", provider), zap.Error(err))
+		}
+
+		if UserAccount[provider] == nil {
+			UserAccount[provider] = ClaimMapping{}
+		}
+		for field, rule := range mapping {
+			UserAccount[provider][field] = rule
+		}
+	}
+}
+
+func (m ClaimMapping) Validate() error {
+	for field, rule := range m {
+		switch field {
+		case NicknameField, EmailField, EmailVerifiedField, PictureField:
+		default:
+			return fmt.Errorf("%w: unknown field %q", ErrInvalidClaimMapping, field)
+		}
+
+		for _, transform := range rule.Transforms {
+			name, _, _ := strings.Cut(transform, ":")
+			if _, ok := claimTransforms[name]; !ok {
+				return fmt.Errorf("%w: unknown transform %q", ErrInvalidClaimMapping, transform)
+			}
+		}
+	}
+	return nil
+}
+
+func (rule ClaimRule) resolve(user goth.User) interface{} {
+	for _, source := range rule.From {
+		var value interface{}
+		if getter, ok := gothUserSources[source]; ok {
+			value = getter(user)
+		} else {
+			value = user.RawData[source]
+		}
+
+		if text, ok := value.(string); ok {
+			for _, transform := range rule.Transforms {
+				name, arg, _ := strings.Cut(transform, ":")
+				text = claimTransforms[name](text, arg)
+			}
+			value = text
+		}
+
+		if value != nil && value != "" {
+			return value
+		}
+	}
+	return nil
+}
+
+func (m ClaimMapping) stringField(user goth.User, field string) (string, error) {
+	rule := m[field]
+	value := rule.resolve(user)
+
+	text, ok := value.(string)
+	if !ok {
+		text = ""
+		if value != nil {
+			text = fmt.Sprint(value)
+		}
+	}
+
+	if text == "" && rule.Required {
+		return "", fmt.Errorf("%w: %s", ErrMissingRequiredClaim, field)
+	}
+	return text, nil
+}
+
+func (m ClaimMapping) MapUser(user goth.User) (User, error) {
+	nickName, err := m.stringField(user, NicknameField)
+	if err != nil {
+		return User{}, err
+	}
+
+	mail, err := m.stringField(user, EmailField)
+	if err != nil {
+		return User{}, err
+	}
+
+	picture, err := m.stringField(user, PictureField)
+	if err != nil {
+		return User{}, err
+	}
+
+	var emailVerified bool
+	switch verified := m[EmailVerifiedField].resolve(user).(type) {
+	case bool:
+		emailVerified = verified
+	case string:
+		emailVerified = verified == "true"
+	}
+
+	var email *string
+	if mail != "" {
+		email = &mail
+	}
+
+	var expiresAt *time.Time
+	if !user.ExpiresAt.IsZero() {
+		expiresAt = &user.ExpiresAt
+	}
+
+	return User{
+		ID:                     uuid.New(),
+		Provider:               user.Provider,
+		ProviderUserID:         user.UserID,
+		NickName:               nickName,
+		Email:                  email,
+		EmailVerified:          email != nil && emailVerified,
+		ImgURL:                 picture,
+		ProviderAccessToken:    user.AccessToken,
+		ProviderRefreshToken:   &user.RefreshToken,
+		ProviderTokenExpiresAt: expiresAt,
+		Status:                 Pending,
+		Role:                   NormalUser,
+		Terms:                  false,
+	}, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type ClientRequest struct {
+	ClientID             string   `json:"client_id"`
+	Name                 string   `json:"name"`
+	Public               bool     `json:"public"`
+	RedirectURIs         []string `json:"redirect_uris"`
+	GrantTypes           []string `json:"grant_types"`
+	Scopes               []string `json:"scopes"`
+	Audiences            []string `json:"audiences"`
+	AccessTokenLifetime  int64    `json:"access_token_lifetime"`
+	RefreshTokenLifetime int64    `json:"refresh_token_lifetime"`
+}
+
+type ClientResponse struct {
+	ClientID             string    `json:"client_id"`
+	ClientSecret         string    `json:"client_secret,omitempty"`
+	Name                 string    `json:"name"`
+	Public               bool      `json:"public"`
+	RedirectURIs         []string  `json:"redirect_uris"`
+	GrantTypes           []string  `json:"grant_types"`
+	Scopes               []string  `json:"scopes"`
+	Audiences            []string  `json:"audiences"`
+	AccessTokenLifetime  int64     `json:"access_token_lifetime"`
+	RefreshTokenLifetime int64     `json:"refresh_token_lifetime"`
+	CreatedAt            time.Time `json:"created_at"`
+}
+
+type ClientSecretResponse struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+func (req ClientRequest) registration() ClientRegistration {
+	return ClientRegistration{
+		Name:                 req.Name,
+		Public:               req.Public,
+		RedirectURIs:         req.RedirectURIs,
+		GrantTypes:           req.GrantTypes,
+		Scopes:               req.Scopes,
+		Audiences:            req.Audiences,
+		AccessTokenLifetime:  time.Duration(req.AccessTokenLifetime) * time.Second,
+		RefreshTokenLifetime: time.Duration(req.RefreshTokenLifetime) * time.Second,
+	}
+}
+
+func newClientResponse(client *Client, secret string) ClientResponse {
+	lifetimes := client.TokenLifetimes()
+	return ClientResponse{
+		ClientID:             client.ID,
+		ClientSecret:         secret,
+		Name:                 client.Name,
+		Public:               !client.IsConfidential(),
+		RedirectURIs:         client.RedirectURIs,
+		GrantTypes:           client.GrantTypes,
+		Scopes:               client.Scopes,
+		Audiences:            client.Audiences,
+		AccessTokenLifetime:  int64(lifetimes.Access.Seconds()),
+		RefreshTokenLifetime: int64(lifetimes.Refresh.Seconds()),
+		CreatedAt:            client.CreatedAt,
+	}
+}
+
+func writeClientError(w http.ResponseWriter, method string, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidClient):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrUnknownClient):
+		http.Error(w, "Client not found", http.StatusNotFound)
+	case errors.Is(err, ErrClientAlreadyExists):
+		http.Error(w, "Client already exists", http.StatusConflict)
+	case errors.Is(err, ErrConfiguredClientEdit):
+		http.Error(w, "Client is configured through the environment", http.StatusConflict)
+	case errors.Is(err, ErrPublicClientSecret):
+		http.Error(w, "Public clients have no secret", http.StatusConflict)
+	default:
+		logger.Error("Error on manage client", zap.String("method", method), zap.Error(err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+	}
+}
+
+func adminClientsHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "adminClientsHandler"
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		clients, err := ListRegisteredClients()
+		if err != nil {
+			writeClientError(w, method, err)
+			return
+		}
+
+		response := make([]ClientResponse, 0, len(clients))
+		for _, client := range clients {
+			response = append(response, newClientResponse(client, ""))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	case http.MethodPost:
+		var request ClientRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if request.ClientID == "" {
+			request.ClientID = uuid.New().String()
+		}
+
+		client, secret, err := RegisterClient(request.ClientID, request.registration())
+		if err != nil {
+			writeClientError(w, method, err)
+			return
+		}
+
+		logger.Info("Client registered", zap.String("client_id", client.ID), zap.String("correlation_id", correlationId))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newClientResponse(client, secret))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func adminClientHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "adminClientHandler"
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	clientId := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		client, err := GetClientRegistration(clientId)
+		if err != nil {
+			writeClientError(w, method, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newClientResponse(client, ""))
+	case http.MethodPut:
+		var request ClientRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		client, err := UpdateClient(clientId, request.registration())
+		if err != nil {
+			writeClientError(w, method, err)
+			return
+		}
+
+		logger.Info("Client updated", zap.String("client_id", client.ID), zap.String("correlation_id", correlationId))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newClientResponse(client, ""))
+	case http.MethodDelete:
+		if err := DeleteClient(clientId); err != nil {
+			writeClientError(w, method, err)
+			return
+		}
+
+		logger.Info("Client deleted", zap.String("client_id", clientId), zap.String("correlation_id", correlationId))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func adminClientSecretHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "adminClientSecretHandler"
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPost:
+		clientId := r.PathValue("id")
+		secret, err := RotateClientSecret(clientId)
+		if err != nil {
+			writeClientError(w, method, err)
+			return
+		}
+
+		logger.Info("Client secret rotated", zap.String("client_id", clientId), zap.String("correlation_id", correlationId))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(ClientSecretResponse{ClientID: clientId, ClientSecret: secret})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+type clientScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanRegisteredClient(row clientScanner) (*Client, error) {
+	var client Client
+	var accessLifetime, refreshLifetime sql.NullInt64
+
+	err := row.Scan(&client.ID, &client.Name, &client.SecretHash,
+		pq.Array(&client.RedirectURIs), pq.Array(&client.GrantTypes), pq.Array(&client.Scopes),
+		pq.Array(&client.Audiences), &accessLifetime, &refreshLifetime, &client.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	client.AccessTokenLifetime = time.Duration(accessLifetime.Int64) * time.Second
+	client.RefreshTokenLifetime = time.Duration(refreshLifetime.Int64) * time.Second
+
+	// Rules were validated when the client was saved.
+	client.RedirectRules, err = parseRedirectRules(client.RedirectURIs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &client, nil
+}
+
+func lifetimeSeconds(lifetime time.Duration) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(lifetime.Seconds()), Valid: lifetime > 0}
+}
+
+func CreateRegisteredClient(client *Client) error {
+	_, err := db.Exec(`
+		INSERT INTO oauth_clients (client_id, name, client_secret_hash, redirect_uris,
+			grant_types, scopes, audiences, access_token_lifetime, refresh_token_lifetime)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		client.ID, client.Name, client.SecretHash, pq.Array(client.RedirectURIs),
+		pq.Array(client.GrantTypes), pq.Array(client.Scopes), pq.Array(client.Audiences),
+		lifetimeSeconds(client.AccessTokenLifetime), lifetimeSeconds(client.RefreshTokenLifetime))
+
+	if isUniqueViolation(err) {
+		return ErrClientAlreadyExists
+	} else if err != nil {
+		logger.Error("Error on create client", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func GetRegisteredClient(clientId string) (*Client, error) {
+	client, err := scanRegisteredClient(db.QueryRow(`
+	SELECT client_id, name, client_secret_hash, redirect_uris, grant_types, scopes,
+		audiences, access_token_lifetime, refresh_token_lifetime, created_at
+	FROM oauth_clients
+	WHERE client_id = $1`,
+		clientId))
+
+	if err != nil && err != sql.ErrNoRows {
+		logger.Error("Error on get client", zap.Error(err))
+	}
+
+	return client, err
+}
+
+func GetRegisteredClients() ([]*Client, error) {
+	rows, err := db.Query(`
+	SELECT client_id, name, client_secret_hash, redirect_uris, grant_types, scopes,
+		audiences, access_token_lifetime, refresh_token_lifetime, created_at
+	FROM oauth_clients
+	ORDER BY client_id`)
+
+	if err != nil {
+		logger.Error("Error on get clients", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*Client{}
+	for rows.Next() {
+		client, err := scanRegisteredClient(rows)
+		if err != nil {
+			logger.Error("Error on scan client", zap.Error(err))
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	return clients, rows.Err()
+}
+
+func UpdateRegisteredClient(client *Client) error {
+	result, err := db.Exec(`
+		UPDATE oauth_clients SET
+			name = $1,
+			redirect_uris = $2,
+			grant_types = $3,
+			scopes = $4,
+			audiences = $5,
+			access_token_lifetime = $6,
+			refresh_token_lifetime = $7,
+			updated_at = NOW()
+		WHERE client_id = $8`,
+		client.Name, pq.Array(client.RedirectURIs), pq.Array(client.GrantTypes), pq.Array(client.Scopes),
+		pq.Array(client.Audiences), lifetimeSeconds(client.AccessTokenLifetime), lifetimeSeconds(client.RefreshTokenLifetime), client.ID)
+
+	if err != nil {
+		logger.Error("Error on update client", zap.Error(err))
+		return err
+	}
+
+	return expectClientRow(result)
+}
+
+func UpdateRegisteredClientSecret(clientId, secretHash string) error {
+	result, err := db.Exec(`
+		UPDATE oauth_clients SET
+			client_secret_hash = $1,
+			updated_at = NOW()
+		WHERE client_id = $2`,
+		secretHash, clientId)
+
+	if err != nil {
+		logger.Error("Error on update client secret", zap.Error(err))
+		return err
+	}
+
+	return expectClientRow(result)
+}
+
+func DeleteRegisteredClient(clientId string) error {
+	result, err := db.Exec(`DELETE FROM oauth_clients WHERE client_id = $1`, clientId)
+
+	if err != nil {
+		logger.Error("Error on delete client", zap.Error(err))
+		return err
+	}
+
+	return expectClientRow(result)
+}
+
+func expectClientRow(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUnknownClient
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrClientAlreadyExists  = errors.New("client id already in use")
+	ErrInvalidClient        = errors.New("invalid client registration")
+	ErrPublicClientSecret   = errors.New("public clients have no secret")
+	ErrConfiguredClientEdit = errors.New("client is configured through FRONTEND_CLIENTS")
+)
+
+// Access tokens are never checked against a key retirement window, but
+// refresh tokens must not outlive the retention of the key that signed them.
+const (
+	MaxClientAccessTokenLifetime  = 24 * time.Hour
+	MaxClientRefreshTokenLifetime = RefreshTokenLifetime
+)
+
+const registeredOriginsTTL = time.Minute
+
+var clientIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// ClientRegistration is what an administrator sets on a registered client.
+type ClientRegistration struct {
+	Name                 string
+	Public               bool
+	RedirectURIs         []string
+	GrantTypes           []string
+	Scopes               []string
+	Audiences            []string
+	AccessTokenLifetime  time.Duration
+	RefreshTokenLifetime time.Duration
+}
+
+// registeredOrigins caches the origins of every registered client, because
+// the CORS middleware checks them on each request.
+var registeredOrigins struct {
+	sync.RWMutex
+	rules    []RedirectRule
+	loadedAt time.Time
+}
+
+func generateClientSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func isValidScopeToken(value string) bool {
+	return value != "" && !strings.ContainsAny(value, " \t\"\\")
+}
+
+// apply validates the registration against the client it is applied to, which
+// already knows whether it is confidential.
+func (reg ClientRegistration) apply(client *Client) error {
+	grantTypes := reg.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = defaultClientGrantTypes
+	}
+	for _, grantType := range grantTypes {
+		if !slices.Contains(supportedGrantTypes, grantType) {
+			return fmt.Errorf("%w: unsupported grant type %q", ErrInvalidClient, grantType)
+		}
+	}
+
+	for _, grantType := range confidentialGrantTypes {
+		if slices.Contains(grantTypes, grantType) && !client.IsConfidential() {
+			return fmt.Errorf("%w: public clients cannot use the %s grant", ErrInvalidClient, grantType)
+		}
+	}
+
+	if len(reg.RedirectURIs) == 0 && slices.Contains(grantTypes, GrantAuthorizationCode) {
+		return fmt.Errorf("%w: at least one redirect URI is required", ErrInvalidClient)
+	}
+
+	rules, err := parseRedirectRules(reg.RedirectURIs)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidClient, err)
+	}
+
+	scopes := reg.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultClientScopes
+	}
+	for _, scope := range scopes {
+		if !isValidScopeToken(scope) {
+			return fmt.Errorf("%w: invalid scope %q", ErrInvalidClient, scope)
+		}
+	}
+
+	for _, audience := range reg.Audiences {
+		if !isValidScopeToken(audience) {
+			return fmt.Errorf("%w: invalid audience %q", ErrInvalidClient, audience)
+		}
+	}
+
+	if reg.AccessTokenLifetime < 0 || reg.AccessTokenLifetime > MaxClientAccessTokenLifetime {
+		return fmt.Errorf("%w: access token lifetime out of range", ErrInvalidClient)
+	}
+	if reg.RefreshTokenLifetime < 0 || reg.RefreshTokenLifetime > MaxClientRefreshTokenLifetime {
+		return fmt.Errorf("%w: refresh token lifetime out of range", ErrInvalidClient)
+	}
+
+	client.Name = reg.Name
+	client.RedirectURIs = append([]string{}, reg.RedirectURIs...)
+	client.RedirectRules = rules
+	client.GrantTypes = grantTypes
+	client.Scopes = scopes
+	client.Audiences = append([]string{}, reg.Audiences...)
+	client.AccessTokenLifetime = reg.AccessTokenLifetime
+	client.RefreshTokenLifetime = reg.RefreshTokenLifetime
+	return nil
+}
+
+// RegisterClient stores a new client. The plain secret of a confidential
+// client is only returned here and is never retrievable afterwards.
+func RegisterClient(clientId string, reg ClientRegistration) (*Client, string, error) {
+	if !clientIdPattern.MatchString(clientId) {
+		return nil, "", fmt.Errorf("%w: client_id must be 1-64 letters, digits, '.', '_' or '-'", ErrInvalidClient)
+	}
+	if _, configured := gClients[clientId]; configured {
+		return nil, "", ErrClientAlreadyExists
+	}
+
+	client := &Client{ID: clientId, CreatedAt: time.Now()}
+
+	var secret string
+	if !reg.Public {
+		var err error
+		secret, err = generateClientSecret()
+		if err != nil {
+			return nil, "", err
+		}
+		secretHash := hashToken(secret)
+		client.SecretHash = &secretHash
+	}
+
+	if err := reg.apply(client); err != nil {
+		return nil, "", err
+	}
+
+	if err := CreateRegisteredClient(client); err != nil {
+		return nil, "", err
+	}
+
+	invalidateRegisteredOrigins()
+	return client, secret, nil
+}
+
+func ListRegisteredClients() ([]*Client, error) {
+	return GetRegisteredClients()
+}
+
+func GetClientRegistration(clientId string) (*Client, error) {
+	if _, configured := gClients[clientId]; configured {
+		return nil, ErrConfiguredClientEdit
+	}
+	return GetClient(clientId)
+}
+
+// UpdateClient replaces the registration of a client. Whether it is public is
+// fixed when it is registered.
+func UpdateClient(clientId string, reg ClientRegistration) (*Client, error) {
+	client, err := GetClientRegistration(clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := reg.apply(client); err != nil {
+		return nil, err
+	}
+
+	if err := UpdateRegisteredClient(client); err != nil {
+		return nil, err
+	}
+
+	invalidateRegisteredOrigins()
+	return client, nil
+}
+
+// RotateClientSecret replaces the secret of a confidential client; the
+// previous secret stops working immediately.
+func RotateClientSecret(clientId string) (string, error) {
+	client, err := GetClientRegistration(clientId)
+	if err != nil {
+		return "", err
+	}
+
+	if !client.IsConfidential() {
+		return "", ErrPublicClientSecret
+	}
+
+	secret, err := generateClientSecret()
+	if err != nil {
+		return "", err
+	}
+
+	if err := UpdateRegisteredClientSecret(clientId, hashToken(secret)); err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+func DeleteClient(clientId string) error {
+	if _, configured := gClients[clientId]; configured {
+		return ErrConfiguredClientEdit
+	}
+
+	if err := DeleteRegisteredClient(clientId); err != nil {
+		return err
+	}
+
+	invalidateRegisteredOrigins()
+	return nil
+}
+
+func invalidateRegisteredOrigins() {
+	registeredOrigins.Lock()
+	registeredOrigins.loadedAt = time.Time{}
+	registeredOrigins.Unlock()
+}
+
+func registeredClientAllowsOrigin(origin string) bool {
+	registeredOrigins.RLock()
+	rules, fresh := registeredOrigins.rules, time.Since(registeredOrigins.loadedAt) < registeredOriginsTTL
+	registeredOrigins.RUnlock()
+
+	if !fresh {
+		clients, err := GetRegisteredClients()
+		if err != nil {
+			logger.Warn("Error on load registered client origins", zap.Error(err))
+		} else {
+			rules = rules[:0:0]
+			for _, client := range clients {
+				rules = append(rules, client.RedirectRules...)
+			}
+
+			registeredOrigins.Lock()
+			registeredOrigins.rules = rules
+			registeredOrigins.loadedAt = time.Now()
+			registeredOrigins.Unlock()
+		}
+	}
+
+	for _, rule := range rules {
+		if rule.AllowsOrigin(origin) {
+			return true
+		}
+	}
+	return false
+}
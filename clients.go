@@ -0,0 +1,342 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	urlp "net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrUnknownClient       = errors.New("unknown client")
+	ErrInvalidRedirectURI  = errors.New("redirect_uri is not registered for this client")
+	ErrInvalidReturnToPath = errors.New("return_to must be a relative path")
+	ErrInvalidClientSecret = errors.New("client authentication failed")
+)
+
+const DefaultClientID = "default"
+
+// RedirectRule matches a redirect URI either exactly or, when PathPrefix is
+// set, by origin plus a path prefix ending on a segment boundary.
+type RedirectRule struct {
+	Exact      string
+	Origin     string
+	PathPrefix string
+}
+
+// Client is an application allowed to start logins. Clients come from
+// FRONTEND_CLIENTS or from the oauth_clients table; only the latter can be
+// confidential or override the default token lifetimes.
+type Client struct {
+	ID                   string
+	Name                 string
+	SecretHash           *string
+	RedirectURIs         []string
+	RedirectRules        []RedirectRule
+	GrantTypes           []string
+	Scopes               []string
+	Audiences            []string
+	AccessTokenLifetime  time.Duration
+	RefreshTokenLifetime time.Duration
+	CreatedAt            time.Time
+}
+
+var defaultClientScopes = []string{OpenIDScope, "profile", "email"}
+
+var gClients = map[string]*Client{}
+
+// initClients reads FRONTEND_CLIENTS, formatted as
+// "web=https://app.example.com/*|https://app.example.com/callback;cli=...".
+// A trailing "*" makes a path-prefix rule. Without it, the
+// ALLOWED_FRONTEND_HOSTS entries become prefix rules of the default client.
+func initClients() {
+	clientsStr := os.Getenv("FRONTEND_CLIENTS")
+	if clientsStr == "" {
+		var rules []string
+		for _, host := range gAppAllowedHosts {
+			rules = append(rules, host+"*")
+		}
+		clientsStr = DefaultClientID + "=" + strings.Join(rules, "|")
+	}
+
+	clients, err := parseClients(clientsStr)
+	if err != nil {
+		logger.Fatal("Setup Project Error | Invalid FRONTEND_CLIENTS", zap.Error(err))
+	}
+	gClients = clients
+}
+
+func parseClients(clientsStr string) (map[string]*Client, error) {
+	clients := map[string]*Client{}
+
+	for _, entry := range strings.Split(clientsStr, ";") {
+		id, rulesStr, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || id == "" {
+			return nil, fmt.Errorf("invalid client entry %q", entry)
+		}
+
+		client := &Client{
+			ID:         id,
+			GrantTypes: defaultClientGrantTypes,
+			Scopes:     defaultClientScopes,
+		}
+		for _, ruleStr := range strings.Split(rulesStr, "|") {
+			client.RedirectURIs = append(client.RedirectURIs, strings.TrimSpace(ruleStr))
+		}
+
+		rules, err := parseRedirectRules(client.RedirectURIs)
+		if err != nil {
+			return nil, fmt.Errorf("client %s: %w", id, err)
+		}
+		client.RedirectRules = rules
+		clients[id] = client
+	}
+
+	return clients, nil
+}
+
+func parseRedirectRules(ruleStrs []string) ([]RedirectRule, error) {
+	rules := make([]RedirectRule, 0, len(ruleStrs))
+	for _, ruleStr := range ruleStrs {
+		rule, err := parseRedirectRule(ruleStr)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRedirectRule(ruleStr string) (RedirectRule, error) {
+	prefix, isPrefix := strings.CutSuffix(ruleStr, "*")
+
+	uri, err := parseRedirectURI(prefix)
+	if err != nil {
+		return RedirectRule{}, err
+	}
+
+	if !isPrefix {
+		return RedirectRule{Exact: uri.String()}, nil
+	}
+
+	path := uri.Path
+	if path == "" {
+		path = "/"
+	}
+	return RedirectRule{Origin: originOf(uri), PathPrefix: path}, nil
+}
+
+func parseRedirectURI(rawURI string) (*urlp.URL, error) {
+	uri, err := urlp.Parse(rawURI)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRedirectURI, err)
+	}
+
+	if (uri.Scheme != "https" && uri.Scheme != "http") || uri.Host == "" ||
+		uri.User != nil || uri.Fragment != "" {
+		return nil, ErrInvalidRedirectURI
+	}
+	return uri, nil
+}
+
+func originOf(uri *urlp.URL) string {
+	return strings.ToLower(uri.Scheme + "://" + uri.Host)
+}
+
+func (rule RedirectRule) Matches(uri *urlp.URL) bool {
+	if rule.Exact != "" {
+		return rule.Exact == uri.String()
+	}
+
+	if originOf(uri) != rule.Origin || strings.Contains(uri.Path, "..") {
+		return false
+	}
+	if uri.Path == rule.PathPrefix || uri.Path+"/" == rule.PathPrefix {
+		return true
+	}
+
+	// The prefix only covers whole path segments: "/cb" allows "/cb/done"
+	// but not "/cb-evil".
+	return strings.HasPrefix(uri.Path, rule.PathPrefix) &&
+		(strings.HasSuffix(rule.PathPrefix, "/") || uri.Path[len(rule.PathPrefix)] == '/')
+}
+
+func (rule RedirectRule) AllowsOrigin(origin string) bool {
+	if rule.Exact != "" {
+		uri, err := urlp.Parse(rule.Exact)
+		return err == nil && originOf(uri) == strings.ToLower(origin)
+	}
+	return rule.Origin == strings.ToLower(origin)
+}
+
+func GetClient(clientId string) (*Client, error) {
+	if clientId == "" {
+		clientId = DefaultClientID
+	}
+
+	if client, ok := gClients[clientId]; ok {
+		return client, nil
+	}
+
+	client, err := GetRegisteredClient(clientId)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownClient, clientId)
+	} else if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// authenticateClient identifies the caller of the token endpoint. Confidential
+// clients send their secret with HTTP Basic or in the form body; public
+// clients only name themselves and rely on PKCE.
+func authenticateClient(r *http.Request) (*Client, error) {
+	clientId, secret, usingBasic := r.BasicAuth()
+	if usingBasic {
+		// RFC 6749 section 2.3.1 form-encodes both values before Basic encoding.
+		var idErr, secretErr error
+		clientId, idErr = urlp.QueryUnescape(clientId)
+		secret, secretErr = urlp.QueryUnescape(secret)
+		if idErr != nil || secretErr != nil {
+			return nil, ErrInvalidClientSecret
+		}
+	} else {
+		clientId = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	if clientId == "" {
+		return nil, ErrUnknownClient
+	}
+
+	client, err := GetClient(clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.IsConfidential() && !matchesTokenHash(client.SecretHash, secret) {
+		return nil, ErrInvalidClientSecret
+	}
+	return client, nil
+}
+
+func (c *Client) IsConfidential() bool {
+	return c.SecretHash != nil
+}
+
+func (c *Client) AllowsGrant(grantType string) bool {
+	return slices.Contains(c.GrantTypes, grantType)
+}
+
+// AllowsScope reports whether every scope in the space-separated list was
+// registered for the client.
+func (c *Client) AllowsScope(scope string) bool {
+	for _, requested := range strings.Fields(scope) {
+		if !slices.Contains(c.Scopes, requested) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsAudience reports whether client_credentials tokens of the client may
+// be issued for the audience.
+func (c *Client) AllowsAudience(audience string) bool {
+	return slices.Contains(c.Audiences, audience)
+}
+
+func (c *Client) TokenLifetimes() TokenLifetimes {
+	lifetimes := defaultTokenLifetimes
+	if c.AccessTokenLifetime > 0 {
+		lifetimes.Access = c.AccessTokenLifetime
+	}
+	if c.RefreshTokenLifetime > 0 {
+		lifetimes.Refresh = c.RefreshTokenLifetime
+	}
+	return lifetimes
+}
+
+// tokenLifetimesFor resolves the lifetimes of a session's tokens. First-party
+// sessions carry no client and always get the defaults.
+func tokenLifetimesFor(clientId string) TokenLifetimes {
+	if clientId == "" {
+		return defaultTokenLifetimes
+	}
+
+	client, err := GetClient(clientId)
+	if err != nil {
+		return defaultTokenLifetimes
+	}
+	return client.TokenLifetimes()
+}
+
+// ValidateRedirectURI returns the parsed redirect URI when it matches one of
+// the client's registered rules.
+func (c *Client) ValidateRedirectURI(rawURI string) (*urlp.URL, error) {
+	uri, err := parseRedirectURI(rawURI)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range c.RedirectRules {
+		if rule.Matches(uri) {
+			return uri, nil
+		}
+	}
+	return nil, ErrInvalidRedirectURI
+}
+
+func validateReturnTo(returnTo string) error {
+	if returnTo == "" {
+		return nil
+	}
+
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") ||
+		strings.Contains(returnTo, "\\") {
+		return ErrInvalidReturnToPath
+	}
+
+	uri, err := urlp.Parse(returnTo)
+	if err != nil || uri.Scheme != "" || uri.Host != "" {
+		return ErrInvalidReturnToPath
+	}
+	return nil
+}
+
+func isOriginAllowed(origin string) bool {
+	for _, client := range gClients {
+		for _, rule := range client.RedirectRules {
+			if rule.AllowsOrigin(origin) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// buildClientRedirect appends params to the registered redirect URI, keeping
+// any query it already carries.
+func buildClientRedirect(redirectURI string, params urlp.Values) string {
+	uri, err := urlp.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+
+	query := uri.Query()
+	for key, values := range params {
+		for _, value := range values {
+			if value != "" {
+				query.Add(key, value)
+			}
+		}
+	}
+	uri.RawQuery = query.Encode()
+	return uri.String()
+}
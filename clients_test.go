@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRedirectRuleMatches(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		uri  string
+		want bool
+	}{
+		{name: "exact match", rule: "https://app.example.com/callback", uri: "https://app.example.com/callback", want: true},
+		{name: "exact with extra path", rule: "https://app.example.com/callback", uri: "https://app.example.com/callback/x", want: false},
+		{name: "exact with query", rule: "https://app.example.com/callback", uri: "https://app.example.com/callback?next=1", want: false},
+		{name: "exact on another host", rule: "https://app.example.com/callback", uri: "https://evil.example.com/callback", want: false},
+		{name: "prefix itself", rule: "https://app.example.com/cb*", uri: "https://app.example.com/cb", want: true},
+		{name: "prefix with trailing slash", rule: "https://app.example.com/cb/*", uri: "https://app.example.com/cb", want: true},
+		{name: "prefix sub path", rule: "https://app.example.com/cb*", uri: "https://app.example.com/cb/done", want: true},
+		{name: "prefix sibling segment", rule: "https://app.example.com/cb*", uri: "https://app.example.com/cb-evil", want: false},
+		{name: "slash prefix sibling segment", rule: "https://app.example.com/cb/*", uri: "https://app.example.com/cbx", want: false},
+		{name: "root prefix", rule: "https://app.example.com/*", uri: "https://app.example.com/anything", want: true},
+		{name: "prefix traversal", rule: "https://app.example.com/cb*", uri: "https://app.example.com/cb/../admin", want: false},
+		{name: "prefix on another origin", rule: "https://app.example.com/*", uri: "http://app.example.com/cb", want: false},
+		{name: "prefix on another port", rule: "https://app.example.com/*", uri: "https://app.example.com:8443/cb", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := parseRedirectRule(tt.rule)
+			if err != nil {
+				t.Fatalf("parse rule: %v", err)
+			}
+			uri, err := parseRedirectURI(tt.uri)
+			if err != nil {
+				t.Fatalf("parse uri: %v", err)
+			}
+
+			if got := rule.Matches(uri); got != tt.want {
+				t.Fatalf("Matches(%q) = %v, want %v", tt.uri, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateReturnTo(t *testing.T) {
+	tests := []struct {
+		returnTo string
+		valid    bool
+	}{
+		{returnTo: "", valid: true},
+		{returnTo: "/", valid: true},
+		{returnTo: "/settings/profile?tab=security", valid: true},
+		{returnTo: "//evil.example.com", valid: false},
+		{returnTo: "//evil.example.com/path", valid: false},
+		{returnTo: "/\\evil.example.com", valid: false},
+		{returnTo: "\\\\evil.example.com", valid: false},
+		{returnTo: "https://evil.example.com", valid: false},
+		{returnTo: "javascript:alert(1)", valid: false},
+		{returnTo: "settings", valid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.returnTo, func(t *testing.T) {
+			err := validateReturnTo(tt.returnTo)
+			if tt.valid && err != nil {
+				t.Fatalf("expected %q to be accepted, got %v", tt.returnTo, err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidReturnToPath) {
+				t.Fatalf("expected ErrInvalidReturnToPath for %q, got %v", tt.returnTo, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+var commands = map[string]func() error{
+	"rotate-signing-key":        rotateSigningKeyCommand,
+	"reencrypt-provider-tokens": reencryptProviderTokensCommand,
+	"reencrypt-signing-keys":    reencryptSigningKeysCommand,
+}
+
+func runCommand(name string) {
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		os.Exit(2)
+	}
+
+	if err := command(); err != nil {
+		logger.Error("Command failed", zap.String("command", name), zap.Error(err))
+		os.Exit(1)
+	}
+}
+
+func rotateSigningKeyCommand() error {
+	key, err := RotateSigningKey(os.Getenv("NEXT_ACCESS_TOKEN_SECRET"))
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Signing key rotated", zap.String("kid", key.ID), zap.String("algorithm", key.Method.Alg()))
+	return nil
+}
+
+// reencryptProviderTokensCommand moves every stored provider token under the
+// active TOKEN_ENCRYPTION_ACTIVE_KEY, so retired keys can be removed.
+func reencryptProviderTokensCommand() error {
+	stored, err := GetStoredIdentityTokens()
+	if err != nil {
+		return err
+	}
+
+	var updated, skipped int
+	for _, previous := range stored {
+		next := storedIdentityTokens{ID: previous.ID}
+		var accessChanged, refreshChanged bool
+
+		if previous.AccessToken != nil {
+			token, changed, err := gTokenCipher.Reencrypt(*previous.AccessToken)
+			if err != nil {
+				return fmt.Errorf("identity %s: %w", previous.ID, err)
+			}
+			next.AccessToken, accessChanged = &token, changed
+		}
+
+		if previous.RefreshToken != nil {
+			token, changed, err := gTokenCipher.Reencrypt(*previous.RefreshToken)
+			if err != nil {
+				return fmt.Errorf("identity %s: %w", previous.ID, err)
+			}
+			next.RefreshToken, refreshChanged = &token, changed
+		}
+
+		if !accessChanged && !refreshChanged {
+			continue
+		}
+
+		replaced, err := ReplaceStoredIdentityTokens(previous, next)
+		if err != nil {
+			return err
+		}
+		if replaced {
+			updated++
+		} else {
+			skipped++
+		}
+	}
+
+	logger.Info("Provider tokens re-encrypted", zap.String("kid", gTokenCipher.activeKeyID),
+		zap.Int("updated", updated), zap.Int("changed_concurrently", skipped))
+	return nil
+}
+
+// reencryptSigningKeysCommand encrypts signing keys stored in plaintext and
+// moves encrypted ones under the active TOKEN_ENCRYPTION_ACTIVE_KEY.
+func reencryptSigningKeysCommand() error {
+	stored, err := GetStoredSigningKeys()
+	if err != nil {
+		return err
+	}
+
+	var updated, skipped int
+	for _, previous := range stored {
+		privateKey, changed, err := gTokenCipher.Reencrypt(previous.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("signing key %s: %w", previous.ID, err)
+		}
+		if !changed {
+			continue
+		}
+
+		replaced, err := ReplaceStoredSigningKey(previous, privateKey)
+		if err != nil {
+			return err
+		}
+		if replaced {
+			updated++
+		} else {
+			skipped++
+		}
+	}
+
+	logger.Info("Signing keys re-encrypted", zap.String("kid", gTokenCipher.activeKeyID),
+		zap.Int("updated", updated), zap.Int("changed_concurrently", skipped))
+	return nil
+}
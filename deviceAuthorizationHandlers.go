@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	urlp "net/url"
+	"time"
+
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+	"go.uber.org/zap"
+)
+
+// RFC 8628 section 3.5 error codes.
+const (
+	OAuthAuthorizationPending = "authorization_pending"
+	OAuthSlowDown             = "slow_down"
+	OAuthExpiredToken         = "expired_token"
+	OAuthAccessDenied         = "access_denied"
+)
+
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+type deviceVerificationPage struct {
+	UserCode  string
+	ClientID  string
+	Scope     string
+	Providers []providerChoice
+	Error     string
+	Approved  bool
+	Denied    bool
+}
+
+var deviceVerificationTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Connect a device</title></head>
+<body>
+<h1>Connect a device</h1>
+{{if .Approved}}<p>Your device is connected. You can return to it now.</p>
+{{else if .Denied}}<p>The device was not connected. You can close this page.</p>
+{{else if .Providers}}<p><strong>{{.ClientID}}</strong> is asking to sign in on a device showing the code <strong>{{.UserCode}}</strong>{{if .Scope}} with access to <em>{{.Scope}}</em>{{end}}.</p>
+<p>Only continue if the code matches your device.</p>
+<ul>
+{{range .Providers}}<li><a href="{{.URL}}">Continue with {{.Name}}</a></li>
+{{end}}</ul>
+<form method="post">
+<input type="hidden" name="user_code" value="{{.UserCode}}">
+<button type="submit">Deny</button>
+</form>
+{{else}}{{if .Error}}<p>{{.Error}}</p>
+{{end}}<form method="get">
+<label for="user_code">Enter the code shown on your device</label>
+<input id="user_code" name="user_code" value="{{.UserCode}}" autocomplete="off" autofocus>
+<button type="submit">Continue</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+func deviceVerificationURI() string {
+	return issuerURL() + "/oauth/device"
+}
+
+func renderDeviceVerification(w http.ResponseWriter, status int, page deviceVerificationPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	deviceVerificationTemplate.Execute(w, page)
+}
+
+// deviceAuthorizationHandler is the RFC 8628 device authorization endpoint.
+func deviceAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "deviceAuthorizationHandler"
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, OAuthInvalidRequest, "malformed form body")
+		return
+	}
+
+	client, err := authenticateClient(r)
+	if err != nil {
+		logger.Warn("Client authentication failed", zap.String("method", method), zap.Error(err))
+		writeOAuthError(w, http.StatusUnauthorized, OAuthInvalidClient, "client authentication failed")
+		return
+	}
+
+	if !client.AllowsGrant(GrantDeviceCode) {
+		writeOAuthError(w, http.StatusBadRequest, OAuthUnauthorizedClient, "client may not use the device flow")
+		return
+	}
+
+	codes, err := StartDeviceAuthorization(client, r.PostForm.Get("scope"))
+	if errors.Is(err, ErrInvalidScope) {
+		writeOAuthError(w, http.StatusBadRequest, OAuthInvalidScope, "")
+		return
+	} else if err != nil {
+		logger.Error("Error on start device authorization", zap.String("method", method), zap.Error(err))
+		writeOAuthError(w, http.StatusInternalServerError, OAuthServerError, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(DeviceAuthorizationResponse{
+		DeviceCode:              codes.DeviceCode,
+		UserCode:                codes.UserCode,
+		VerificationURI:         deviceVerificationURI(),
+		VerificationURIComplete: deviceVerificationURI() + "?" + urlp.Values{"user_code": {codes.UserCode}}.Encode(),
+		ExpiresIn:               int64(codes.ExpiresIn.Seconds()),
+		Interval:                int64(codes.Interval.Seconds()),
+	})
+}
+
+// deviceVerificationHandler is the page where the user types the code shown
+// on the device and approves it by signing in with one of the providers, or
+// denies it.
+func deviceVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "deviceVerificationHandler"
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	if r.Method == http.MethodPost {
+		denyDevice(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	userCode := query.Get("user_code")
+	if userCode == "" {
+		renderDeviceVerification(w, http.StatusOK, deviceVerificationPage{})
+		return
+	}
+
+	auth, err := FindPendingDeviceAuthorization(userCode)
+	if err != nil {
+		logger.Warn("Unknown device user code", zap.String("method", method), zap.Error(err))
+		renderDeviceVerification(w, http.StatusNotFound, deviceVerificationPage{
+			UserCode: userCode,
+			Error:    "That code is not valid or has expired. Check your device and try again.",
+		})
+		return
+	}
+
+	provider := query.Get("provider")
+	if provider == "" {
+		page := deviceVerificationPage{
+			UserCode: formatUserCode(auth.UserCode),
+			ClientID: auth.ClientID,
+			Scope:    auth.Scope,
+		}
+		for _, name := range providerIndex.Providers {
+			choice := urlp.Values{"user_code": {auth.UserCode}, "provider": {name}}
+			page.Providers = append(page.Providers, providerChoice{
+				Name: providerIndex.ProvidersMap[name],
+				URL:  r.URL.Path + "?" + choice.Encode(),
+			})
+		}
+		renderDeviceVerification(w, http.StatusOK, page)
+		return
+	}
+
+	if _, err := goth.GetProvider(provider); err != nil {
+		http.Error(w, "Unknown provider.", http.StatusBadRequest)
+		return
+	}
+
+	urlStr, err := gothic.GetAuthURL(w, r)
+	if err != nil {
+		logger.Error("Error on start upstream login", zap.String("method", method), zap.Error(err))
+		http.Error(w, "Could not start the login.", http.StatusInternalServerError)
+		return
+	}
+
+	parsedURL, err := urlp.Parse(urlStr)
+	if err != nil {
+		logger.Error("Failed to parse Auth URL string", zap.Error(err), zap.String("url", urlStr))
+		http.Error(w, "Could not start the login.", http.StatusInternalServerError)
+		return
+	}
+
+	err = gLoginStates.Save(parsedURL.Query().Get("state"), LoginState{
+		ClientID:       auth.ClientID,
+		Delivery:       DeviceDelivery,
+		Scope:          auth.Scope,
+		DeviceUserCode: auth.UserCode,
+		ExpiresAt:      time.Now().Add(LoginStateLifetime),
+	})
+	if err != nil {
+		http.Error(w, "Could not store the login.", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, urlStr, http.StatusFound)
+}
+
+// completeDeviceApproval finishes a login started from the verification page.
+func completeDeviceApproval(w http.ResponseWriter, user User, sessionData LoginState) {
+	err := ApproveDevice(sessionData.DeviceUserCode, user)
+	if errors.Is(err, ErrUserCodeNotFound) {
+		renderDeviceVerification(w, http.StatusNotFound, deviceVerificationPage{
+			Error: "That code expired while you were signing in. Start again on your device.",
+		})
+		return
+	} else if err != nil {
+		logger.Error("Error on approve device", zap.Error(err))
+		http.Error(w, "Error on approve device.", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Device approved", zap.String("client_id", sessionData.ClientID), zap.String("user_id", user.ID.String()))
+	renderDeviceVerification(w, http.StatusOK, deviceVerificationPage{Approved: true})
+}
+
+// denyDevice handles the deny button of the verification page. The device
+// gets access_denied on its next poll.
+func denyDevice(w http.ResponseWriter, r *http.Request) {
+	userCode := r.PostFormValue("user_code")
+	err := DenyDevice(userCode)
+	if errors.Is(err, ErrUserCodeNotFound) {
+		renderDeviceVerification(w, http.StatusNotFound, deviceVerificationPage{
+			UserCode: userCode,
+			Error:    "That code is not valid or has expired. Check your device and try again.",
+		})
+		return
+	} else if err != nil {
+		logger.Error("Error on deny device", zap.Error(err))
+		http.Error(w, "Error on deny device.", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Info("Device denied")
+	renderDeviceVerification(w, http.StatusOK, deviceVerificationPage{Denied: true})
+}
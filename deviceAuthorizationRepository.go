@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type DeviceAuthorizationStatus string
+
+const (
+	DevicePending  DeviceAuthorizationStatus = "pending"
+	DeviceApproved DeviceAuthorizationStatus = "approved"
+	DeviceDenied   DeviceAuthorizationStatus = "denied"
+	DeviceConsumed DeviceAuthorizationStatus = "consumed"
+)
+
+type DeviceAuthorization struct {
+	UserCode     string
+	ClientID     string
+	Scope        string
+	UserID       *uuid.UUID
+	Status       DeviceAuthorizationStatus
+	Interval     time.Duration
+	LastPolledAt *time.Time
+	ExpiresAt    time.Time
+}
+
+func CreateDeviceAuthorization(deviceCodeHash string, auth DeviceAuthorization) error {
+	_, err := db.Exec(`
+		INSERT INTO device_authorizations (device_code_hash, user_code, client_id,
+			scope, status, poll_interval, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		deviceCodeHash, auth.UserCode, auth.ClientID,
+		auth.Scope, auth.Status, int64(auth.Interval.Seconds()), auth.ExpiresAt)
+
+	if err != nil && !isUniqueViolation(err) {
+		logger.Error("Error on create device authorization", zap.Error(err))
+	}
+
+	return err
+}
+
+func GetPendingDeviceAuthorization(userCode string) (DeviceAuthorization, error) {
+	var auth DeviceAuthorization
+	var interval int64
+
+	err := db.QueryRow(`
+	SELECT user_code, client_id, scope, status, poll_interval, expires_at
+	FROM device_authorizations
+	WHERE user_code = $1 AND status = $2 AND expires_at > NOW()`,
+		userCode, DevicePending).Scan(&auth.UserCode, &auth.ClientID, &auth.Scope, &auth.Status, &interval, &auth.ExpiresAt)
+
+	if err != nil && err != sql.ErrNoRows {
+		logger.Error("Error on get device authorization", zap.Error(err))
+	}
+
+	auth.Interval = time.Duration(interval) * time.Second
+	return auth, err
+}
+
+// ApproveDeviceAuthorization binds a still pending code to the user who
+// entered it, reporting false when the code is unknown, used or expired.
+func ApproveDeviceAuthorization(userCode string, userId uuid.UUID) (bool, error) {
+	result, err := db.Exec(`
+		UPDATE device_authorizations SET
+			status = $1,
+			user_id = $2
+		WHERE user_code = $3 AND status = $4 AND expires_at > NOW()`,
+		DeviceApproved, userId, userCode, DevicePending)
+
+	if err != nil {
+		logger.Error("Error on approve device authorization", zap.Error(err))
+		return false, err
+	}
+
+	approved, err := result.RowsAffected()
+	return approved > 0, err
+}
+
+// DenyDeviceAuthorization marks a still pending code as denied, reporting
+// false when the code is unknown, used or expired.
+func DenyDeviceAuthorization(userCode string) (bool, error) {
+	result, err := db.Exec(`
+		UPDATE device_authorizations SET
+			status = $1
+		WHERE user_code = $2 AND status = $3 AND expires_at > NOW()`,
+		DeviceDenied, userCode, DevicePending)
+
+	if err != nil {
+		logger.Error("Error on deny device authorization", zap.Error(err))
+		return false, err
+	}
+
+	denied, err := result.RowsAffected()
+	return denied > 0, err
+}
+
+// PollDeviceAuthorization runs poll under a row lock and stores whatever it
+// changed before returning its error, since a slow_down answer must still
+// persist the longer interval.
+func PollDeviceAuthorization(deviceCodeHash string, poll func(*DeviceAuthorization) error) (DeviceAuthorization, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Error on begin transaction", zap.Error(err))
+		return DeviceAuthorization{}, err
+	}
+	defer tx.Rollback()
+
+	var auth DeviceAuthorization
+	var interval int64
+
+	err = tx.QueryRow(`
+	SELECT user_code, client_id, scope, user_id, status, poll_interval, last_polled_at, expires_at
+	FROM device_authorizations
+	WHERE device_code_hash = $1
+	FOR UPDATE`,
+		deviceCodeHash).Scan(&auth.UserCode, &auth.ClientID, &auth.Scope, &auth.UserID, &auth.Status,
+		&interval, &auth.LastPolledAt, &auth.ExpiresAt)
+
+	if err == sql.ErrNoRows {
+		return DeviceAuthorization{}, ErrInvalidDeviceCode
+	} else if err != nil {
+		logger.Error("Error on lock device authorization", zap.Error(err))
+		return DeviceAuthorization{}, err
+	}
+	auth.Interval = time.Duration(interval) * time.Second
+
+	pollErr := poll(&auth)
+
+	_, err = tx.Exec(`
+		UPDATE device_authorizations SET
+			status = $1,
+			poll_interval = $2,
+			last_polled_at = $3
+		WHERE device_code_hash = $4`,
+		auth.Status, int64(auth.Interval.Seconds()), auth.LastPolledAt, deviceCodeHash)
+
+	if err != nil {
+		logger.Error("Error on update device authorization", zap.Error(err))
+		return DeviceAuthorization{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return DeviceAuthorization{}, err
+	}
+
+	return auth, pollErr
+}
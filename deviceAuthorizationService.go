@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidDeviceCode          = errors.New("device code is invalid or already used")
+	ErrDeviceCodeExpired          = errors.New("device code has expired")
+	ErrDeviceAuthorizationPending = errors.New("device authorization is pending")
+	ErrDeviceSlowDown             = errors.New("device is polling too fast")
+	ErrDeviceAccessDenied         = errors.New("user denied the device authorization")
+	ErrUserCodeNotFound           = errors.New("user code is invalid, expired or already used")
+)
+
+const (
+	DeviceCodeLifetime  = 10 * time.Minute
+	DevicePollInterval  = 5 * time.Second
+	DevicePollSlowDown  = 5 * time.Second
+	userCodeLength      = 8
+	userCodeAlphabet    = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeMaxAttempts = 5
+)
+
+type DeviceCodes struct {
+	DeviceCode string
+	UserCode   string
+	ExpiresIn  time.Duration
+	Interval   time.Duration
+}
+
+// generateUserCode follows RFC 8628 section 6.1: consonants only, so codes
+// are easy to type and never spell words.
+func generateUserCode() (string, error) {
+	alphabetSize := big.NewInt(int64(len(userCodeAlphabet)))
+
+	var code strings.Builder
+	for range userCodeLength {
+		index, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", err
+		}
+		code.WriteByte(userCodeAlphabet[index.Int64()])
+	}
+	return code.String(), nil
+}
+
+// normalizeUserCode accepts what users type: any case, with or without the
+// separator.
+func normalizeUserCode(input string) string {
+	var code strings.Builder
+	for _, char := range strings.ToUpper(input) {
+		if strings.ContainsRune(userCodeAlphabet, char) {
+			code.WriteRune(char)
+		}
+	}
+	return code.String()
+}
+
+func formatUserCode(code string) string {
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+// StartDeviceAuthorization issues the device and user codes for a device that
+// cannot receive a redirect.
+func StartDeviceAuthorization(client *Client, scope string) (DeviceCodes, error) {
+	if !client.AllowsScope(scope) {
+		return DeviceCodes{}, ErrInvalidScope
+	}
+	if err := checkOpenIDScope(scope); err != nil {
+		return DeviceCodes{}, err
+	}
+
+	deviceCode, err := generateAuthorizationCode()
+	if err != nil {
+		return DeviceCodes{}, err
+	}
+
+	for range userCodeMaxAttempts {
+		userCode, err := generateUserCode()
+		if err != nil {
+			return DeviceCodes{}, err
+		}
+
+		err = CreateDeviceAuthorization(hashAuthorizationCode(deviceCode), DeviceAuthorization{
+			UserCode:  userCode,
+			ClientID:  client.ID,
+			Scope:     strings.Join(strings.Fields(scope), " "),
+			Status:    DevicePending,
+			Interval:  DevicePollInterval,
+			ExpiresAt: time.Now().Add(DeviceCodeLifetime),
+		})
+		if isUniqueViolation(err) {
+			continue
+		} else if err != nil {
+			return DeviceCodes{}, err
+		}
+
+		return DeviceCodes{
+			DeviceCode: deviceCode,
+			UserCode:   formatUserCode(userCode),
+			ExpiresIn:  DeviceCodeLifetime,
+			Interval:   DevicePollInterval,
+		}, nil
+	}
+
+	return DeviceCodes{}, fmt.Errorf("no free user code after %d attempts", userCodeMaxAttempts)
+}
+
+func FindPendingDeviceAuthorization(userCode string) (DeviceAuthorization, error) {
+	auth, err := GetPendingDeviceAuthorization(normalizeUserCode(userCode))
+	if err != nil {
+		return DeviceAuthorization{}, fmt.Errorf("%w: %v", ErrUserCodeNotFound, err)
+	}
+	return auth, nil
+}
+
+// ApproveDevice records that the signed in user approved the device showing
+// the user code.
+func ApproveDevice(userCode string, user User) error {
+	approved, err := ApproveDeviceAuthorization(normalizeUserCode(userCode), user.ID)
+	if err != nil {
+		return err
+	}
+	if !approved {
+		return ErrUserCodeNotFound
+	}
+	return nil
+}
+
+// DenyDevice records that the user refused the device showing the user code.
+func DenyDevice(userCode string) error {
+	denied, err := DenyDeviceAuthorization(normalizeUserCode(userCode))
+	if err != nil {
+		return err
+	}
+	if !denied {
+		return ErrUserCodeNotFound
+	}
+	return nil
+}
+
+// nextDevicePoll decides the answer to one poll and updates the pacing state.
+func nextDevicePoll(auth *DeviceAuthorization, clientId string, now time.Time) error {
+	if auth.ClientID != clientId || auth.Status == DeviceConsumed {
+		return ErrInvalidDeviceCode
+	}
+
+	if now.After(auth.ExpiresAt) {
+		return ErrDeviceCodeExpired
+	}
+
+	if auth.Status == DeviceDenied {
+		return ErrDeviceAccessDenied
+	}
+
+	tooFast := auth.LastPolledAt != nil && now.Sub(*auth.LastPolledAt) < auth.Interval
+	auth.LastPolledAt = &now
+	if tooFast {
+		auth.Interval += DevicePollSlowDown
+		return ErrDeviceSlowDown
+	}
+
+	if auth.Status == DevicePending {
+		return ErrDeviceAuthorizationPending
+	}
+
+	auth.Status = DeviceConsumed
+	return nil
+}
+
+// ExchangeDeviceCode implements the device_code grant polled by the device.
+// Once the user approved, the first poll starts the session and the code is
+// spent.
+func ExchangeDeviceCode(deviceCode string, client SessionClient) (ClientTokens, error) {
+	auth, err := PollDeviceAuthorization(hashAuthorizationCode(deviceCode), func(auth *DeviceAuthorization) error {
+		return nextDevicePoll(auth, client.ClientID, time.Now())
+	})
+	if errors.Is(err, ErrInvalidDeviceCode) || errors.Is(err, ErrDeviceCodeExpired) ||
+		errors.Is(err, ErrDeviceAuthorizationPending) || errors.Is(err, ErrDeviceSlowDown) ||
+		errors.Is(err, ErrDeviceAccessDenied) {
+		return ClientTokens{}, err
+	} else if err != nil {
+		return ClientTokens{}, fmt.Errorf("%w: %v", ErrUnexpectedTokenValidation, err)
+	}
+
+	user, err := GetUserByUserId(*auth.UserID)
+	if err != nil {
+		return ClientTokens{}, fmt.Errorf("%w: %v", ErrUserNotFound, err)
+	}
+
+	if err := checkOpenIDScope(auth.Scope); err != nil {
+		return ClientTokens{}, err
+	}
+
+	client.Scope = auth.Scope
+	session, pair, err := StartSession(user, client)
+	if err != nil {
+		return ClientTokens{}, err
+	}
+
+	return withIDToken(ClientTokens{Session: session, Pair: pair, Scope: session.Scope}, user, "")
+}
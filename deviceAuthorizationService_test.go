@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextDevicePoll(t *testing.T) {
+	now := time.Now()
+	recently := now.Add(-time.Second)
+	earlier := now.Add(-time.Minute)
+
+	tests := []struct {
+		name       string
+		status     DeviceAuthorizationStatus
+		clientID   string
+		lastPolled *time.Time
+		expiresAt  time.Time
+		want       error
+		wantStatus DeviceAuthorizationStatus
+	}{
+		{name: "pending", status: DevicePending, clientID: "tv", expiresAt: now.Add(time.Minute), want: ErrDeviceAuthorizationPending, wantStatus: DevicePending},
+		{name: "polling too fast", status: DevicePending, clientID: "tv", lastPolled: &recently, expiresAt: now.Add(time.Minute), want: ErrDeviceSlowDown, wantStatus: DevicePending},
+		{name: "denied", status: DeviceDenied, clientID: "tv", lastPolled: &earlier, expiresAt: now.Add(time.Minute), want: ErrDeviceAccessDenied, wantStatus: DeviceDenied},
+		{name: "denied and expired", status: DeviceDenied, clientID: "tv", expiresAt: now.Add(-time.Second), want: ErrDeviceCodeExpired, wantStatus: DeviceDenied},
+		{name: "approved", status: DeviceApproved, clientID: "tv", lastPolled: &earlier, expiresAt: now.Add(time.Minute), wantStatus: DeviceConsumed},
+		{name: "consumed", status: DeviceConsumed, clientID: "tv", expiresAt: now.Add(time.Minute), want: ErrInvalidDeviceCode, wantStatus: DeviceConsumed},
+		{name: "another client", status: DeviceApproved, clientID: "other", expiresAt: now.Add(time.Minute), want: ErrInvalidDeviceCode, wantStatus: DeviceApproved},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := DeviceAuthorization{
+				ClientID:     tt.clientID,
+				Status:       tt.status,
+				Interval:     DevicePollInterval,
+				LastPolledAt: tt.lastPolled,
+				ExpiresAt:    tt.expiresAt,
+			}
+
+			err := nextDevicePoll(&auth, "tv", now)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+			if auth.Status != tt.wantStatus {
+				t.Fatalf("expected status %q, got %q", tt.wantStatus, auth.Status)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"go.uber.org/zap"
 	"os"
+	"strings"
 )
 
 type AuthProviders struct {
@@ -19,16 +20,47 @@ type DatadogSettings struct {
 	Version            string
 }
 
+type TokenSigningSettings struct {
+	Algorithm      string
+	PrivateKeyFile string
+}
+
+type TokenEncryptionSettings struct {
+	Keys        string
+	ActiveKeyID string
+}
+
+type OIDCProviderSettings struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	Claims       ClaimMapping
+}
+
+type CookieSettings struct {
+	Domain   string
+	SameSite string
+}
+
 type Environment struct {
-	RedirectUrl        string
-	Auths              AuthProviders
-	SessionSecret      string
-	DatabaseConn       string
-	ServerPort         string
-	MetricsPort        string
-	AccessTokenSecret  string
-	RefreshTokenSecret string
-	DatadogSettings    DatadogSettings
+	RedirectUrl          string
+	Auths                AuthProviders
+	SessionSecret        string
+	DatabaseConn         string
+	ServerPort           string
+	MetricsPort          string
+	AccessTokenSecret    string
+	RefreshTokenSecret   string
+	TokenSigningSettings TokenSigningSettings
+	CookieSettings       CookieSettings
+	TokenEncryption      TokenEncryptionSettings
+	LoginStateStore      string
+	OIDCProviders        []OIDCProviderSettings
+	ProviderMappingsFile string
+	DatadogSettings      DatadogSettings
 }
 
 func checkEnvVariable(label string) string {
@@ -41,6 +73,55 @@ func checkEnvVariable(label string) string {
 	return env
 }
 
+func getEnvVariable(label string, fallback string) string {
+	env := os.Getenv(label)
+	if env == "" {
+		return fallback
+	}
+	return env
+}
+
+// loadOIDCProviderSettings reads OIDC_PROVIDERS (e.g. "keycloak,corp") and, for each
+// name, OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET and the optional
+// _SCOPES, _CLAIMS ("nickname=preferred_username|nickname,email=email") and
+// _DISPLAY_NAME.
+func loadOIDCProviderSettings() []OIDCProviderSettings {
+	var providers []OIDCProviderSettings
+
+	for _, name := range strings.Split(getEnvVariable("OIDC_PROVIDERS", ""), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		envPrefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		providers = append(providers, OIDCProviderSettings{
+			Name:         name,
+			DisplayName:  getEnvVariable(envPrefix+"DISPLAY_NAME", name),
+			Issuer:       strings.TrimSuffix(checkEnvVariable(envPrefix+"ISSUER"), "/"),
+			ClientID:     checkEnvVariable(envPrefix + "CLIENT_ID"),
+			ClientSecret: checkEnvVariable(envPrefix + "CLIENT_SECRET"),
+			Scopes:       strings.Split(getEnvVariable(envPrefix+"SCOPES", "openid,email,profile"), ","),
+			Claims: parseClaimMappings(getEnvVariable(envPrefix+"CLAIMS",
+				"nickname=preferred_username|nickname|name,email=email,email_verified=email_verified,picture=picture")),
+		})
+	}
+
+	return providers
+}
+
+func parseClaimMappings(mappings string) ClaimMapping {
+	claims := ClaimMapping{}
+	for _, mapping := range strings.Split(mappings, ",") {
+		field, sources, found := strings.Cut(strings.TrimSpace(mapping), "=")
+		if !found {
+			continue
+		}
+		claims[field] = ClaimRule{From: strings.Split(sources, "|"), Transforms: []string{"trim"}}
+	}
+	return claims
+}
+
 func initEnvironments() *Environment {
 	redirectUrl := checkEnvVariable("REDIRECT_URL")
 	githubKey := checkEnvVariable("AUTH_GITHUB_KEY")
@@ -58,6 +139,18 @@ func initEnvironments() *Environment {
 	serverPort := checkEnvVariable("SERVER_PORT")
 	metricsPort := checkEnvVariable("METRICS_PORT")
 
+	tokenSigningSettings := TokenSigningSettings{
+		Algorithm: getEnvVariable("TOKEN_SIGNING_ALGORITHM", "HS256"),
+	}
+	if tokenSigningSettings.Algorithm != "HS256" {
+		tokenSigningSettings.PrivateKeyFile = checkEnvVariable("TOKEN_SIGNING_KEY_FILE")
+	}
+
+	cookieSettings := CookieSettings{
+		Domain:   getEnvVariable("COOKIE_DOMAIN", ""),
+		SameSite: strings.ToLower(getEnvVariable("COOKIE_SAMESITE", "lax")),
+	}
+
 	datadogSettings := DatadogSettings{
 		AgentHost:          checkEnvVariable("DD_AGENT_HOST"),
 		TraceAgentHostname: checkEnvVariable("DD_TRACE_AGENT_HOSTNAME"),
@@ -81,13 +174,22 @@ func initEnvironments() *Environment {
 				"google": googleSecret,
 			},
 		},
-		SessionSecret:      sessionSecret,
-		DatabaseConn:       databaseString,
-		ServerPort:         serverPort,
-		MetricsPort:        metricsPort,
-		AccessTokenSecret:  accessTokenSecret,
-		RefreshTokenSecret: refreshTokenSecret,
-		DatadogSettings:    datadogSettings,
+		SessionSecret:        sessionSecret,
+		DatabaseConn:         databaseString,
+		ServerPort:           serverPort,
+		MetricsPort:          metricsPort,
+		AccessTokenSecret:    accessTokenSecret,
+		RefreshTokenSecret:   refreshTokenSecret,
+		TokenSigningSettings: tokenSigningSettings,
+		CookieSettings:       cookieSettings,
+		TokenEncryption: TokenEncryptionSettings{
+			Keys:        checkEnvVariable("TOKEN_ENCRYPTION_KEYS"),
+			ActiveKeyID: getEnvVariable("TOKEN_ENCRYPTION_ACTIVE_KEY", ""),
+		},
+		LoginStateStore:      getEnvVariable("LOGIN_STATE_STORE", "memory"),
+		OIDCProviders:        loadOIDCProviderSettings(),
+		ProviderMappingsFile: getEnvVariable("PROVIDER_MAPPINGS_FILE", ""),
+		DatadogSettings:      datadogSettings,
 	}
 
 	logger.Info("Environment variables loaded successfully.")
@@ -3,6 +3,7 @@ module github.com/davypaulino/guardian
 go 1.24.1
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/DataDog/dd-trace-go/contrib/net/http/v2 v2.0.0
 	github.com/DataDog/dd-trace-go/v2 v2.0.0
 	github.com/golang-jwt/jwt/v5 v5.2.2
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	urlp "net/url"
+	"time"
+
+	"github.com/markbates/goth/gothic"
+	"go.uber.org/zap"
+)
+
+type IdentityResponse struct {
+	Provider      string    `json:"provider"`
+	Email         *string   `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type IdentityLinkRequest struct {
+	ClientID    string `json:"client_id"`
+	RedirectURI string `json:"redirect_uri"`
+	ReturnTo    string `json:"return_to"`
+}
+
+type IdentityLinkResponse struct {
+	AuthorizationURL string `json:"authorization_url"`
+}
+
+func identitiesHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "identitiesHandler"
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		current, _ := sessionFromContext(r.Context())
+		identities, err := ListIdentities(current.UserID)
+		if err != nil {
+			logger.Error("Error on list identities", zap.String("method", method), zap.Error(err))
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		response := make([]IdentityResponse, 0, len(identities))
+		for _, identity := range identities {
+			response = append(response, IdentityResponse{
+				Provider:      identity.Provider,
+				Email:         identity.Email,
+				EmailVerified: identity.EmailVerified,
+				CreatedAt:     identity.CreatedAt,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// identityHandler links (POST) or unlinks (DELETE) a provider for the current
+// user. Linking answers with the provider URL the browser must open; the
+// request has to be sent with credentials so the OAuth state cookie sticks.
+func identityHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "identityHandler"
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	current, _ := sessionFromContext(r.Context())
+	provider := r.PathValue("provider")
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPost:
+		var request IdentityLinkRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			logger.Warn("Error on Convert Body", zap.String("method", method), zap.Error(err))
+			http.Error(w, "Erro ao decodificar JSON", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		client, err := GetClient(request.ClientID)
+		if err != nil {
+			http.Error(w, "Unknown client.", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := client.ValidateRedirectURI(request.RedirectURI); err != nil {
+			http.Error(w, "Unauthorized redirect_uri.", http.StatusBadRequest)
+			return
+		}
+
+		if err := validateReturnTo(request.ReturnTo); err != nil {
+			http.Error(w, "Invalid return_to path.", http.StatusBadRequest)
+			return
+		}
+
+		urlStr, err := gothic.GetAuthURL(w, r)
+		if err != nil {
+			logger.Warn("Error on start identity link", zap.String("method", method), zap.String("provider", provider), zap.Error(err))
+			http.Error(w, "Provider not supported.", http.StatusBadRequest)
+			return
+		}
+
+		parsedURL, err := urlp.Parse(urlStr)
+		if err != nil {
+			logger.Error("Failed to parse Auth URL string", zap.Error(err), zap.String("url", urlStr))
+			http.Error(w, "Internal server error during URL parsing.", http.StatusInternalServerError)
+			return
+		}
+
+		err = gLoginStates.Save(parsedURL.Query().Get("state"), LoginState{
+			ClientID:    client.ID,
+			RedirectURL: request.RedirectURI,
+			ReturnTo:    request.ReturnTo,
+			LinkUserID:  &current.UserID,
+			ExpiresAt:   time.Now().Add(LoginStateLifetime),
+		})
+		if err != nil {
+			http.Error(w, "Internal server error during login state storage.", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(IdentityLinkResponse{AuthorizationURL: urlStr})
+	case http.MethodDelete:
+		err := UnlinkIdentity(current.UserID, provider)
+		if errors.Is(err, ErrIdentityNotFound) {
+			http.Error(w, "Identity not found", http.StatusNotFound)
+			return
+		} else if errors.Is(err, ErrLastLoginMethod) {
+			logger.Warn("Refused to unlink last login method", zap.String("method", method), zap.String("provider", provider))
+			http.Error(w, "Cannot unlink the last login method", http.StatusConflict)
+			return
+		} else if err != nil {
+			logger.Error("Error on unlink identity", zap.String("method", method), zap.Error(err))
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
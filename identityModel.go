@@ -0,0 +1,21 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Identity is one provider account that can sign in as a guardian user.
+type Identity struct {
+	ID                     uuid.UUID  `json:"id"`
+	UserID                 uuid.UUID  `json:"user_id"`
+	Provider               string     `json:"provider"`
+	ProviderUserID         string     `json:"provider_user_id"`
+	Email                  *string    `json:"email"`
+	EmailVerified          bool       `json:"email_verified"`
+	ProviderAccessToken    string     `json:"-"`
+	ProviderRefreshToken   *string    `json:"-"`
+	ProviderTokenExpiresAt *time.Time `json:"-"`
+	CreatedAt              time.Time  `json:"created_at"`
+}
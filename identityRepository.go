@@ -0,0 +1,421 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// storedProviderTokens encrypts the identity's provider tokens for storage.
+func storedProviderTokens(identity Identity) (*string, *string, error) {
+	accessToken, err := encryptProviderToken(&identity.ProviderAccessToken)
+	if err != nil {
+		logger.Error("Error on encrypt provider access token", zap.Error(err))
+		return nil, nil, err
+	}
+
+	refreshToken, err := encryptProviderToken(identity.ProviderRefreshToken)
+	if err != nil {
+		logger.Error("Error on encrypt provider refresh token", zap.Error(err))
+		return nil, nil, err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// loadProviderTokens decrypts the provider tokens read from the database.
+func loadProviderTokens(accessToken *string, refreshToken *string) (string, *string, error) {
+	accessToken, err := decryptProviderToken(accessToken)
+	if err != nil {
+		logger.Error("Error on decrypt provider access token", zap.Error(err))
+		return "", nil, err
+	}
+
+	refreshToken, err = decryptProviderToken(refreshToken)
+	if err != nil {
+		logger.Error("Error on decrypt provider refresh token", zap.Error(err))
+		return "", nil, err
+	}
+
+	if accessToken == nil {
+		return "", refreshToken, nil
+	}
+	return *accessToken, refreshToken, nil
+}
+
+func CreateUserWithIdentity(user User, identity Identity) error {
+	accessToken, refreshToken, err := storedProviderTokens(identity)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Error on begin transaction", zap.Error(err))
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO users (id, nickname, email, avatar_url, status,
+			"role", terms_accepted, email_verified)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		user.ID, user.NickName, user.Email, user.ImgURL, user.Status,
+		user.Role, user.Terms, user.EmailVerified)
+
+	if err != nil {
+		logger.Error("Error on create user", zap.Error(err))
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO user_identities (id, user_id, provider, provider_user_id,
+			email, email_verified, provider_access_token, provider_refresh_token,
+			provider_token_expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		identity.ID, identity.UserID, identity.Provider, identity.ProviderUserID,
+		identity.Email, identity.EmailVerified, accessToken, refreshToken,
+		identity.ProviderTokenExpiresAt)
+
+	if err != nil {
+		logger.Error("Error on create user identity", zap.Error(err))
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// isNicknameTaken tells a clash on users.nickname apart from the identity
+// races CreateUserWithIdentity can also hit.
+func isNicknameTaken(err error) bool {
+	var pqErr *pq.Error
+	return isUniqueViolation(err) && errors.As(err, &pqErr) && pqErr.Constraint == "users_nickname_key"
+}
+
+func CreateIdentity(identity Identity) error {
+	accessToken, refreshToken, err := storedProviderTokens(identity)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO user_identities (id, user_id, provider, provider_user_id,
+			email, email_verified, provider_access_token, provider_refresh_token,
+			provider_token_expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		identity.ID, identity.UserID, identity.Provider, identity.ProviderUserID,
+		identity.Email, identity.EmailVerified, accessToken, refreshToken,
+		identity.ProviderTokenExpiresAt)
+
+	if isUniqueViolation(err) {
+		return ErrIdentityAlreadyLinked
+	} else if err != nil {
+		logger.Error("Error on create user identity", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func GetUserByIdentity(provider string, providerUserId string) (User, error) {
+	var user User
+	var accessToken, refreshToken *string
+
+	err := db.QueryRow(`
+	SELECT u.id, u.nickname, u.email, u.avatar_url, u.status,
+		u.role, u.terms_accepted, u.email_verified,
+		i.provider, i.provider_user_id,
+		i.provider_access_token, i.provider_refresh_token
+	FROM user_identities i
+	JOIN users u ON u.id = i.user_id
+	WHERE i.provider = $1 AND i.provider_user_id = $2`,
+		provider, providerUserId).Scan(&user.ID, &user.NickName, &user.Email, &user.ImgURL, &user.Status,
+		&user.Role, &user.Terms, &user.EmailVerified,
+		&user.Provider, &user.ProviderUserID,
+		&accessToken, &refreshToken)
+
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logger.Error("Error on get user by identity", zap.Error(err))
+		}
+		return User{}, err
+	}
+
+	user.ProviderAccessToken, user.ProviderRefreshToken, err = loadProviderTokens(accessToken, refreshToken)
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// UpdateIdentityProviderTokens stores the tokens from a new login. Providers
+// such as Google only return a refresh token on first consent, so an empty
+// one keeps the stored value.
+func UpdateIdentityProviderTokens(identity Identity) error {
+	accessToken, refreshToken, err := storedProviderTokens(identity)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		UPDATE user_identities SET
+			email = $1,
+			email_verified = $2,
+			provider_access_token = $3,
+			provider_refresh_token = COALESCE(NULLIF($4, ''), provider_refresh_token),
+			provider_token_expires_at = $5,
+			updated_at = NOW()
+		WHERE provider = $6 AND provider_user_id = $7`,
+		identity.Email, identity.EmailVerified, accessToken,
+		refreshToken, identity.ProviderTokenExpiresAt, identity.Provider, identity.ProviderUserID)
+
+	if err != nil {
+		logger.Error("Error on update identity provider tokens", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func GetUserIdentity(userId uuid.UUID, provider string) (Identity, error) {
+	var identity Identity
+	var accessToken, refreshToken *string
+
+	err := db.QueryRow(`
+	SELECT id, user_id, provider, provider_user_id, email, email_verified,
+		provider_access_token, provider_refresh_token, provider_token_expires_at,
+		created_at
+	FROM user_identities
+	WHERE user_id = $1 AND provider = $2`,
+		userId, provider).Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.ProviderUserID,
+		&identity.Email, &identity.EmailVerified, &accessToken, &refreshToken, &identity.ProviderTokenExpiresAt,
+		&identity.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return Identity{}, ErrIdentityNotFound
+	} else if err != nil {
+		logger.Error("Error on get user identity", zap.Error(err))
+		return Identity{}, err
+	}
+
+	identity.ProviderAccessToken, identity.ProviderRefreshToken, err = loadProviderTokens(accessToken, refreshToken)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	return identity, nil
+}
+
+func GetIdentitiesByUserId(userId uuid.UUID) ([]Identity, error) {
+	rows, err := db.Query(`
+	SELECT id, user_id, provider, provider_user_id, email,
+		email_verified, created_at
+	FROM user_identities
+	WHERE user_id = $1
+	ORDER BY created_at`,
+		userId)
+
+	if err != nil {
+		logger.Error("Error on list user identities", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []Identity
+	for rows.Next() {
+		var identity Identity
+		err := rows.Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.ProviderUserID,
+			&identity.Email, &identity.EmailVerified, &identity.CreatedAt)
+		if err != nil {
+			logger.Error("Error on scan user identity", zap.Error(err))
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
+
+func ClearIdentityProviderTokens(identityId uuid.UUID) error {
+	_, err := db.Exec(`
+		UPDATE user_identities SET
+			provider_access_token = NULL,
+			provider_refresh_token = NULL,
+			provider_token_expires_at = NULL,
+			updated_at = NOW()
+		WHERE id = $1`,
+		identityId)
+
+	if err != nil {
+		logger.Error("Error on clear provider tokens", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// DeleteUserIdentity locks the user row so concurrent unlinks cannot remove
+// the last remaining identity between the count and the delete.
+func DeleteUserIdentity(userId uuid.UUID, provider string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Error on begin transaction", zap.Error(err))
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`SELECT id FROM users WHERE id = $1 FOR UPDATE`, userId)
+	if err != nil {
+		logger.Error("Error on lock user", zap.Error(err))
+		return err
+	}
+
+	var identities int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM user_identities WHERE user_id = $1`, userId).Scan(&identities)
+	if err != nil {
+		logger.Error("Error on count user identities", zap.Error(err))
+		return err
+	}
+
+	result, err := tx.Exec(`
+		DELETE FROM user_identities
+		WHERE user_id = $1 AND provider = $2`,
+		userId, provider)
+	if err != nil {
+		logger.Error("Error on delete user identity", zap.Error(err))
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrIdentityNotFound
+	}
+	if identities <= 1 {
+		return ErrLastLoginMethod
+	}
+
+	return tx.Commit()
+}
+
+// RefreshIdentityProviderTokens runs refresh while holding a row lock on the
+// identity, so concurrent callers wait for the first refresh and see its
+// result instead of replaying a refresh token the provider already rotated.
+// refresh reports whether it changed the tokens.
+func RefreshIdentityProviderTokens(identityId uuid.UUID, refresh func(Identity) (Identity, bool, error)) (Identity, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Error on begin transaction", zap.Error(err))
+		return Identity{}, err
+	}
+	defer tx.Rollback()
+
+	var identity Identity
+	var accessToken, refreshToken *string
+
+	err = tx.QueryRow(`
+	SELECT id, user_id, provider, provider_user_id, email, email_verified,
+		provider_access_token, provider_refresh_token, provider_token_expires_at
+	FROM user_identities
+	WHERE id = $1
+	FOR UPDATE`,
+		identityId).Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.ProviderUserID,
+		&identity.Email, &identity.EmailVerified, &accessToken, &refreshToken, &identity.ProviderTokenExpiresAt)
+
+	if err == sql.ErrNoRows {
+		return Identity{}, ErrIdentityNotFound
+	} else if err != nil {
+		logger.Error("Error on lock user identity", zap.Error(err))
+		return Identity{}, err
+	}
+
+	identity.ProviderAccessToken, identity.ProviderRefreshToken, err = loadProviderTokens(accessToken, refreshToken)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	identity, changed, err := refresh(identity)
+	if err != nil || !changed {
+		return identity, err
+	}
+
+	accessToken, refreshToken, err = storedProviderTokens(identity)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE user_identities SET
+			provider_access_token = $1,
+			provider_refresh_token = $2,
+			provider_token_expires_at = $3,
+			updated_at = NOW()
+		WHERE id = $4`,
+		accessToken, refreshToken, identity.ProviderTokenExpiresAt, identity.ID)
+
+	if err != nil {
+		logger.Error("Error on update identity provider tokens", zap.Error(err))
+		return Identity{}, err
+	}
+
+	return identity, tx.Commit()
+}
+
+type storedIdentityTokens struct {
+	ID           uuid.UUID
+	AccessToken  *string
+	RefreshToken *string
+}
+
+func GetStoredIdentityTokens() ([]storedIdentityTokens, error) {
+	rows, err := db.Query(`
+	SELECT id, provider_access_token, provider_refresh_token
+	FROM user_identities
+	WHERE provider_access_token IS NOT NULL OR provider_refresh_token IS NOT NULL`)
+
+	if err != nil {
+		logger.Error("Error on list stored provider tokens", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []storedIdentityTokens
+	for rows.Next() {
+		var stored storedIdentityTokens
+		if err := rows.Scan(&stored.ID, &stored.AccessToken, &stored.RefreshToken); err != nil {
+			logger.Error("Error on scan stored provider tokens", zap.Error(err))
+			return nil, err
+		}
+		tokens = append(tokens, stored)
+	}
+
+	return tokens, rows.Err()
+}
+
+// ReplaceStoredIdentityTokens only writes when the row still holds the values
+// that were read, so a concurrent login is never overwritten.
+func ReplaceStoredIdentityTokens(previous storedIdentityTokens, next storedIdentityTokens) (bool, error) {
+	result, err := db.Exec(`
+		UPDATE user_identities SET
+			provider_access_token = $1,
+			provider_refresh_token = $2
+		WHERE id = $3
+			AND provider_access_token IS NOT DISTINCT FROM $4
+			AND provider_refresh_token IS NOT DISTINCT FROM $5`,
+		next.AccessToken, next.RefreshToken, previous.ID,
+		previous.AccessToken, previous.RefreshToken)
+
+	if err != nil {
+		logger.Error("Error on replace stored provider tokens", zap.Error(err))
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	return updated == 1, err
+}
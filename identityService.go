@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/markbates/goth"
+)
+
+var (
+	ErrIdentityAlreadyLinked = errors.New("provider identity is already linked to an account")
+	ErrIdentityNotFound      = errors.New("identity not found")
+	ErrLastLoginMethod       = errors.New("cannot unlink the last login method")
+)
+
+func newIdentity(user User) Identity {
+	return Identity{
+		ID:                     uuid.New(),
+		UserID:                 user.ID,
+		Provider:               user.Provider,
+		ProviderUserID:         user.ProviderUserID,
+		Email:                  user.Email,
+		EmailVerified:          user.EmailVerified,
+		ProviderAccessToken:    user.ProviderAccessToken,
+		ProviderRefreshToken:   user.ProviderRefreshToken,
+		ProviderTokenExpiresAt: user.ProviderTokenExpiresAt,
+	}
+}
+
+func mapProviderUser(user goth.User) (User, error) {
+	mapping, ok := UserAccount[user.Provider]
+	if !ok {
+		return User{}, fmt.Errorf("%w: %s", ErrProviderNotSupported, user.Provider)
+	}
+	return mapping.MapUser(user)
+}
+
+// LinkIdentity attaches a provider account to an existing user. Linking an
+// identity the user already owns only refreshes its provider tokens.
+func LinkIdentity(userId uuid.UUID, user goth.User) (Identity, error) {
+	newUser, err := mapProviderUser(user)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	identity := newIdentity(newUser)
+	identity.UserID = userId
+
+	owner, err := GetUserByIdentity(identity.Provider, identity.ProviderUserID)
+	if err == nil {
+		if owner.ID != userId {
+			return Identity{}, ErrIdentityAlreadyLinked
+		}
+		return identity, UpdateIdentityProviderTokens(identity)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return Identity{}, err
+	}
+
+	if err := CreateIdentity(identity); err != nil {
+		return Identity{}, err
+	}
+	return identity, nil
+}
+
+func UnlinkIdentity(userId uuid.UUID, provider string) error {
+	return DeleteUserIdentity(userId, provider)
+}
+
+func ListIdentities(userId uuid.UUID) ([]Identity, error) {
+	return GetIdentitiesByUserId(userId)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+type IntrospectionResponse struct {
+	Active     bool           `json:"active"`
+	Subject    string         `json:"sub,omitempty"`
+	Scope      string         `json:"scope,omitempty"`
+	ClientID   string         `json:"client_id,omitempty"`
+	Audience   []string       `json:"aud,omitempty"`
+	Issuer     string         `json:"iss,omitempty"`
+	JTI        string         `json:"jti,omitempty"`
+	TokenType  string         `json:"token_type,omitempty"`
+	TokenUse   string         `json:"token_use,omitempty"`
+	ExpiresAt  int64          `json:"exp,omitempty"`
+	IssuedAt   int64          `json:"iat,omitempty"`
+	UserStatus *UserStatus    `json:"user_status,omitempty"`
+	Actor      map[string]any `json:"act,omitempty"`
+}
+
+// tokenTypeHints maps RFC 7662 token_type_hint values.
+var tokenTypeHints = map[string]TokenType{
+	"access_token":  Access,
+	"refresh_token": Refresh,
+}
+
+// authenticateResourceServer accepts the callers allowed to introspect: service
+// clients and confidential OAuth clients.
+func authenticateResourceServer(r *http.Request) (string, error) {
+	if service, err := authenticateServiceClient(r); err == nil {
+		return service.ID, nil
+	}
+
+	client, err := authenticateClient(r)
+	if err != nil {
+		return "", err
+	}
+	if !client.IsConfidential() {
+		return "", ErrInvalidClientSecret
+	}
+	return client.ID, nil
+}
+
+func newIntrospectionResponse(introspection Introspection) IntrospectionResponse {
+	if !introspection.Active {
+		return IntrospectionResponse{Active: false}
+	}
+
+	return IntrospectionResponse{
+		Active:     true,
+		Subject:    introspection.Subject,
+		Scope:      introspection.Scope,
+		ClientID:   introspection.ClientID,
+		Audience:   introspection.Audience,
+		Issuer:     introspection.Issuer,
+		JTI:        introspection.JTI,
+		TokenType:  "Bearer",
+		TokenUse:   tokenTypeClaims[introspection.TokenUse],
+		ExpiresAt:  introspection.ExpiresAt,
+		IssuedAt:   introspection.IssuedAt,
+		UserStatus: introspection.UserStatus,
+		Actor:      introspection.Actor,
+	}
+}
+
+// introspectionHandler is the RFC 7662 introspection endpoint, so resource
+// servers can check revocation without reaching the database.
+func introspectionHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "introspectionHandler"
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, OAuthInvalidRequest, "malformed form body")
+		return
+	}
+
+	caller, err := authenticateResourceServer(r)
+	if err != nil {
+		logger.Warn("Introspection caller authentication failed", zap.String("method", method), zap.Error(err))
+		writeOAuthError(w, http.StatusUnauthorized, OAuthInvalidClient, "client authentication failed")
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, OAuthInvalidRequest, "token is required")
+		return
+	}
+
+	introspection, err := IntrospectToken(token, tokenTypeHints[r.PostForm.Get("token_type_hint")])
+	if err != nil {
+		logger.Error("Error on introspect token", zap.String("method", method), zap.Error(err))
+		writeOAuthError(w, http.StatusInternalServerError, OAuthServerError, "")
+		return
+	}
+
+	logger.Info("Token introspected", zap.String("caller", caller), zap.Bool("active", introspection.Active),
+		zap.String("correlation_id", correlationId))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(newIntrospectionResponse(introspection))
+}
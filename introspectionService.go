@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Introspection is the RFC 7662 view of a token. Only Active is meaningful
+// for tokens that are not active.
+type Introspection struct {
+	Active     bool
+	Subject    string
+	Scope      string
+	ClientID   string
+	Audience   []string
+	Issuer     string
+	JTI        string
+	TokenUse   TokenType
+	ExpiresAt  int64
+	IssuedAt   int64
+	UserStatus *UserStatus
+	Actor      map[string]any
+	SessionID  uuid.UUID
+}
+
+var inactiveToken = Introspection{}
+
+// IntrospectToken checks a token the way the routes that accept it would:
+// its signature and expiry through ValidateToken, then the session or client
+// it belongs to. Lookup failures are errors; anything else about the token
+// just makes it inactive.
+func IntrospectToken(token string, hint TokenType) (Introspection, error) {
+	claims, tokenType, err := ValidateAnyToken(token, hint)
+	if err != nil {
+		return inactiveToken, err
+	} else if claims == nil {
+		return inactiveToken, nil
+	}
+
+	introspection := introspectionFromClaims(claims, tokenType)
+	if stringClaim(claims, "sid") == "" {
+		return introspectClientToken(introspection, claims, tokenType)
+	}
+	return introspectSessionToken(introspection, token, claims, tokenType)
+}
+
+func introspectionFromClaims(claims *jwt.MapClaims, tokenType TokenType) Introspection {
+	introspection := Introspection{
+		Active:   true,
+		Scope:    stringClaim(claims, "scope"),
+		ClientID: stringClaim(claims, "client_id"),
+		Issuer:   stringClaim(claims, "iss"),
+		JTI:      stringClaim(claims, "jti"),
+		TokenUse: tokenType,
+	}
+
+	introspection.Actor, _ = (*claims)["act"].(map[string]any)
+
+	introspection.Subject, _ = claims.GetSubject()
+	introspection.Audience, _ = claims.GetAudience()
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		introspection.ExpiresAt = exp.Unix()
+	}
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		introspection.IssuedAt = iat.Unix()
+	}
+
+	return introspection
+}
+
+// introspectClientToken covers client_credentials tokens, which stay active
+// only while their client is registered.
+func introspectClientToken(introspection Introspection, claims *jwt.MapClaims, tokenType TokenType) (Introspection, error) {
+	if tokenType != Access || introspection.ClientID == "" || introspection.Subject != introspection.ClientID {
+		return inactiveToken, nil
+	}
+
+	_, err := GetClient(introspection.ClientID)
+	if errors.Is(err, ErrUnknownClient) {
+		return inactiveToken, nil
+	} else if err != nil {
+		return Introspection{}, err
+	}
+
+	return introspection, nil
+}
+
+// introspectSessionToken covers user tokens: the session must be live, an
+// access token must be the session's current one, and a refresh token must
+// be neither rotated nor in a revoked family. Delegated tokens from a token
+// exchange are never the session's current token and keep their own client
+// and scope.
+func introspectSessionToken(introspection Introspection, token string, claims *jwt.MapClaims, tokenType TokenType) (Introspection, error) {
+	sessionId, err := uuid.Parse(stringClaim(claims, "sid"))
+	if err != nil {
+		return inactiveToken, nil
+	}
+
+	session, err := GetSessionById(sessionId)
+	if err == sql.ErrNoRows {
+		return inactiveToken, nil
+	} else if err != nil {
+		return Introspection{}, err
+	}
+
+	if session.RevokedAt != nil || session.UserID.String() != introspection.Subject {
+		return inactiveToken, nil
+	}
+
+	switch tokenType {
+	case Access:
+		if introspection.Actor == nil && !matchesTokenHash(session.AccessTokenHash, token) {
+			return inactiveToken, nil
+		}
+	case Refresh:
+		state, err := GetRefreshTokenState(introspection.JTI)
+		if err == sql.ErrNoRows {
+			return inactiveToken, nil
+		} else if err != nil {
+			return Introspection{}, err
+		}
+		if state.RevokedAt != nil || state.RotatedAt != nil || state.FamilyID != session.FamilyID {
+			return inactiveToken, nil
+		}
+	}
+
+	user, err := GetUserByUserId(session.UserID)
+	if err != nil {
+		return Introspection{}, fmt.Errorf("%w: %v", ErrUserNotFound, err)
+	}
+
+	if introspection.Actor == nil {
+		introspection.ClientID = session.ClientID
+		introspection.Scope = session.Scope
+	}
+	introspection.UserStatus = &user.Status
+	introspection.SessionID = session.ID
+	return introspection, nil
+}
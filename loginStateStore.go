@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var ErrLoginStateNotFound = errors.New("login state not found or expired")
+
+const LoginStateLifetime = 5 * time.Minute
+
+type LoginState struct {
+	ClientID       string
+	RedirectURL    string
+	ReturnTo       string
+	CodeChallenge  string
+	Delivery       TokenDelivery
+	ClientState    string
+	Scope          string
+	Nonce          string
+	LinkUserID     *uuid.UUID
+	DeviceUserCode string
+	ExpiresAt      time.Time
+}
+
+// LoginStateStore keeps in-flight OAuth logins between the redirect to the
+// provider and its callback. Take must be atomic so a state is used once.
+type LoginStateStore interface {
+	Save(state string, login LoginState) error
+	Take(state string) (LoginState, error)
+	DeleteExpired() (int64, error)
+}
+
+var gLoginStates LoginStateStore
+
+func initLoginStateStore() {
+	switch environments.LoginStateStore {
+	case "postgres":
+		gLoginStates = &PostgresLoginStateStore{}
+	default:
+		gLoginStates = NewMemoryLoginStateStore()
+	}
+
+	go cleanupExpiredLoginStates()
+}
+
+func cleanupExpiredLoginStates() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		deleted, err := gLoginStates.DeleteExpired()
+		if err != nil {
+			logger.Error("Error on clean up expired login states", zap.Error(err))
+			continue
+		}
+		logger.Debug("Cleaned up expired login states.", zap.Int64("deleted", deleted))
+	}
+}
+
+// MemoryLoginStateStore only works when the callback reaches the replica
+// that started the login.
+type MemoryLoginStateStore struct {
+	sync.Mutex
+	data map[string]LoginState
+}
+
+func NewMemoryLoginStateStore() *MemoryLoginStateStore {
+	return &MemoryLoginStateStore{data: make(map[string]LoginState)}
+}
+
+func (s *MemoryLoginStateStore) Save(state string, login LoginState) error {
+	s.Lock()
+	defer s.Unlock()
+	s.data[state] = login
+	return nil
+}
+
+func (s *MemoryLoginStateStore) Take(state string) (LoginState, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	login, found := s.data[state]
+	delete(s.data, state)
+	if !found || time.Now().After(login.ExpiresAt) {
+		return LoginState{}, ErrLoginStateNotFound
+	}
+	return login, nil
+}
+
+func (s *MemoryLoginStateStore) DeleteExpired() (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var deleted int64
+	for state, login := range s.data {
+		if time.Now().After(login.ExpiresAt) {
+			delete(s.data, state)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// PostgresLoginStateStore lets any replica complete any login.
+type PostgresLoginStateStore struct{}
+
+func (s *PostgresLoginStateStore) Save(state string, login LoginState) error {
+	_, err := db.Exec(`
+		INSERT INTO login_states (state, client_id, redirect_url, return_to,
+			code_challenge, delivery, client_state, scope, nonce, link_user_id,
+			device_user_code, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		state, login.ClientID, login.RedirectURL, login.ReturnTo,
+		login.CodeChallenge, login.Delivery, login.ClientState, login.Scope,
+		login.Nonce, login.LinkUserID, login.DeviceUserCode, login.ExpiresAt)
+
+	if err != nil {
+		logger.Error("Error on save login state", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func (s *PostgresLoginStateStore) Take(state string) (LoginState, error) {
+	var login LoginState
+
+	err := db.QueryRow(`
+	DELETE FROM login_states
+	WHERE state = $1
+	RETURNING client_id, redirect_url, return_to,
+		code_challenge, delivery, client_state, scope, nonce, link_user_id,
+		device_user_code, expires_at`,
+		state).Scan(&login.ClientID, &login.RedirectURL, &login.ReturnTo,
+		&login.CodeChallenge, &login.Delivery, &login.ClientState, &login.Scope,
+		&login.Nonce, &login.LinkUserID, &login.DeviceUserCode, &login.ExpiresAt)
+
+	if err == sql.ErrNoRows {
+		return LoginState{}, ErrLoginStateNotFound
+	} else if err != nil {
+		logger.Error("Error on take login state", zap.Error(err))
+		return LoginState{}, err
+	}
+
+	if time.Now().After(login.ExpiresAt) {
+		return LoginState{}, ErrLoginStateNotFound
+	}
+	return login, nil
+}
+
+func (s *PostgresLoginStateStore) DeleteExpired() (int64, error) {
+	result, err := db.Exec(`DELETE FROM login_states WHERE expires_at <= $1`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -12,7 +12,6 @@ import (
 	"os"
 	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
@@ -22,55 +21,18 @@ import (
 	"github.com/markbates/goth/gothic"
 )
 
+const apiPrefix = "/api/v1/guardian"
+
 var gAppAllowedHosts = []string{
 	"http://localhost:3000/",
 	"https://localhost:8443/",
 }
 
-var gClientsSessions = struct {
-	sync.Mutex
-	data map[string]struct {
-		RedirectURL string
-		ExpiresAt   time.Time
-	}
-}{
-	data: make(map[string]struct {
-		RedirectURL string
-		ExpiresAt   time.Time
-	}),
-}
-
 func initAppHosts() {
 	allowedHostsStr := os.Getenv("ALLOWED_FRONTEND_HOSTS")
 	if allowedHostsStr != "" {
 		gAppAllowedHosts = strings.Split(allowedHostsStr, ",")
 	}
-
-	go cleanupExpiredSessions()
-}
-
-func cleanupExpiredSessions() {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
-	for range ticker.C {
-		gClientsSessions.Lock()
-		for state, entry := range gClientsSessions.data {
-			if time.Now().After(entry.ExpiresAt) {
-				delete(gClientsSessions.data, state)
-			}
-		}
-		gClientsSessions.Unlock()
-		logger.Debug("Cleaned up expired client sessions.")
-	}
-}
-
-func isHostAllowed(host string) bool {
-	for _, allowedHost := range gAppAllowedHosts {
-		if allowedHost == host {
-			return true
-		}
-	}
-	return false
 }
 
 var db *sql.DB
@@ -95,6 +57,11 @@ type UserTokenResponse struct {
 	RefreshToken string `json:"refresh_token"`
 }
 
+type LogoutResponse struct {
+	LoggedOut       bool `json:"logged_out"`
+	ProviderRevoked bool `json:"provider_revoked"`
+}
+
 type UserTokenRequest struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
@@ -138,22 +105,34 @@ func postUserRegister(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		session, _ := sessionFromContext(r.Context())
+		if session.UserID != user.ID {
+			logger.Warn("Register for another user", zap.String("method", method), zap.String("correlation_id", correlationId))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
 		newUser, err := GetUserByUserId(user.ID)
 		newUser.NickName = user.Nickname
 		newUser.ImgURL = user.AvatarURL
 		newUser.Terms = user.Terms
 		newUser.Status = Active
 
-		token, refresh, err := UpdateUserRegister(newUser)
+		response, err := RegisterUser(newUser, session)
 		if err != nil {
 			logger.Error("Error on Generate Tokens", zap.String("method", method), zap.Error(err))
 			http.Error(w, "Erro ao gerar tokens", http.StatusInternalServerError)
 			return
 		}
 
-		response := UserTokenResponse{
-			AccessToken:  token,
-			RefreshToken: refresh,
+		if authenticatedWithCookie(r) {
+			if err := setTokenCookies(w, response); err != nil {
+				logger.Error("Error on set token cookies", zap.String("method", method), zap.Error(err))
+				http.Error(w, "Erro ao gerar tokens", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -178,26 +157,48 @@ func putRenewTokens(w http.ResponseWriter, r *http.Request) {
 		logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
 		defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
 
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			logger.Warn("Error on Read Body", zap.String("method", method), zap.Error(err))
-			http.Error(w, "Erro ao ler o corpo da requisição", http.StatusBadRequest)
-			return
+		var tokens UserTokenRequest
+		usingCookies := cookieValue(r, RefreshTokenCookie) != ""
+
+		if usingCookies {
+			if !isValidCSRF(r) {
+				logger.Warn("Invalid CSRF token", zap.String("method", method), zap.String("correlation_id", correlationId))
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+			tokens.AccessToken = cookieValue(r, AccessTokenCookie)
+			tokens.RefreshToken = cookieValue(r, RefreshTokenCookie)
+		} else {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				logger.Warn("Error on Read Body", zap.String("method", method), zap.Error(err))
+				http.Error(w, "Erro ao ler o corpo da requisição", http.StatusBadRequest)
+				return
+			}
+			defer r.Body.Close()
+
+			err = json.Unmarshal(body, &tokens)
+			if err != nil {
+				logger.Warn("Error on Convert Body", zap.String("method", method), zap.Error(err))
+				http.Error(w, "Erro ao decodificar JSON", http.StatusBadRequest)
+				return
+			}
 		}
-		defer r.Body.Close()
 
-		var tokens UserTokenRequest
-		err = json.Unmarshal(body, &tokens)
+		response, err := RenewAccessToken(tokens.AccessToken, tokens.RefreshToken, newSessionClient(r))
 		if err != nil {
 			logger.Warn("Error on Convert Body", zap.String("method", method), zap.Error(err))
-			http.Error(w, "Erro ao decodificar JSON", http.StatusBadRequest)
+			http.Error(w, "Token invalido", http.StatusBadRequest)
 			return
 		}
 
-		response, err := RenewAccessToken(tokens.AccessToken, tokens.RefreshToken)
-		if err != nil {
-			logger.Warn("Error on Convert Body", zap.String("method", method), zap.Error(err))
-			http.Error(w, "Token invalido", http.StatusBadRequest)
+		if usingCookies {
+			if err := setTokenCookies(w, response); err != nil {
+				logger.Error("Error on set token cookies", zap.String("method", method), zap.Error(err))
+				http.Error(w, "Erro ao gerar tokens", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 
@@ -209,8 +210,8 @@ func putRenewTokens(w http.ResponseWriter, r *http.Request) {
 
 func getUserInfo(w http.ResponseWriter, r *http.Request) {
 	correlationId := r.Header.Get("X-Correlation-Id")
-	userId := r.URL.Query().Get("userId")
-	logger.Info("Starting | Get User Info", zap.String("userId", userId), zap.String("correlation_id", correlationId))
+	session, _ := sessionFromContext(r.Context())
+	logger.Info("Starting | Get User Info", zap.String("userId", session.UserID.String()), zap.String("correlation_id", correlationId))
 	defer logger.Info("Finished | Get User Info", zap.String("correlation_id", correlationId))
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
@@ -223,12 +224,7 @@ func getUserInfo(w http.ResponseWriter, r *http.Request) {
 		Terms     string `json:"accepted_terms"`
 		AvatarURL string `json:"img_url"`
 	}
-	user.ID = userId
-	if userId == "" || userId == "undefined" {
-		logger.Warn("User Id Param not found.")
-		http.Error(w, "Not found User Id query param", http.StatusBadRequest)
-		return
-	}
+	user.ID = session.UserID.String()
 
 	err := db.QueryRow(`
         SELECT id, nickname, terms_accepted, avatar_url 
@@ -249,19 +245,79 @@ func getUserInfo(w http.ResponseWriter, r *http.Request) {
 }
 
 func logoutHandler(res http.ResponseWriter, req *http.Request) {
+	correlationId := req.Header.Get("X-Correlation-Id")
+	method := "logoutHandler"
+
+	if req.Method == http.MethodOptions {
+		res.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Info("Starting Process", zap.String("http:method", req.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", req.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	session, _ := sessionFromContext(req.Context())
+	revokeProvider := req.URL.Query().Get("revoke_provider") == "true"
+
+	response, err := Logout(session, req.PathValue("provider"), revokeProvider)
+	if err != nil {
+		logger.Error("Error on logout", zap.String("method", method), zap.Error(err))
+		http.Error(res, "Database error", http.StatusInternalServerError)
+		return
+	}
+
 	gothic.Logout(res, req)
-	res.Header().Set("Location", "/")
-	res.WriteHeader(http.StatusTemporaryRedirect)
+	clearTokenCookies(res)
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	json.NewEncoder(res).Encode(response)
 }
 
 func providerAuthHandler(res http.ResponseWriter, req *http.Request) {
-	referer := req.Header.Get("Referer")
+	clientId := req.URL.Query().Get("client_id")
+	client, err := GetClient(clientId)
+	if err != nil {
+		logger.Warn("Unknown client attempting authentication.",
+			zap.String("client_id", clientId))
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(res, "Unknown client.")
+		return
+	}
 
-	if !isHostAllowed(referer) {
-		logger.Warn("Unauthorized host attempting authentication.",
-			zap.String("referer", referer))
+	redirectURI := req.URL.Query().Get("redirect_uri")
+	if _, err := client.ValidateRedirectURI(redirectURI); err != nil {
+		logger.Warn("Unauthorized redirect_uri attempting authentication.",
+			zap.String("client_id", client.ID), zap.String("redirect_uri", redirectURI))
 		res.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintln(res, "Unauthorized request origin.")
+		fmt.Fprintln(res, "Unauthorized redirect_uri.")
+		return
+	}
+
+	returnTo := req.URL.Query().Get("return_to")
+	if err := validateReturnTo(returnTo); err != nil {
+		logger.Warn("Invalid return_to path.", zap.String("return_to", returnTo))
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(res, "Invalid return_to path.")
+		return
+	}
+
+	delivery := CodeDelivery
+	if req.URL.Query().Get("token_delivery") == string(CookieDelivery) {
+		delivery = CookieDelivery
+	}
+
+	codeChallenge := req.URL.Query().Get("code_challenge")
+	if delivery == CodeDelivery && (req.URL.Query().Get("code_challenge_method") != "S256" || !isValidCodeChallenge(codeChallenge)) {
+		logger.Warn("Missing or invalid PKCE code challenge.",
+			zap.String("redirect_uri", redirectURI))
+		res.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(res, "A S256 code_challenge is required.")
 		return
 	}
 
@@ -287,20 +343,25 @@ func providerAuthHandler(res http.ResponseWriter, req *http.Request) {
 		queryParams := parsedURL.Query()
 		state := queryParams.Get("state")
 
-		gClientsSessions.Lock()
-		gClientsSessions.data[state] = struct {
-			RedirectURL string
-			ExpiresAt   time.Time
-		}{
-			RedirectURL: referer,
-			ExpiresAt:   time.Now().Add(5 * time.Minute),
+		err = gLoginStates.Save(state, LoginState{
+			ClientID:      client.ID,
+			RedirectURL:   redirectURI,
+			ReturnTo:      returnTo,
+			CodeChallenge: codeChallenge,
+			Delivery:      delivery,
+			ExpiresAt:     time.Now().Add(LoginStateLifetime),
+		})
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(res, "Internal server error during login state storage.")
+			return
 		}
-		gClientsSessions.Unlock()
 
 		logger.Info("Auth Flow Initiated",
 			zap.String("GothAuthURL", urlStr),
 			zap.String("GothState", state),
-			zap.String("FrontendReturnURL", referer),
+			zap.String("ClientID", client.ID),
+			zap.String("FrontendReturnURL", redirectURI),
 			zap.String("RequestHost", req.Host),
 			zap.String("RequestURI", req.RequestURI),
 		)
@@ -331,8 +392,22 @@ func main() {
 
 	db, _ = initDatabase()
 	providerIndex = initProviders()
+	initTokenEncryption()
+	initKeyRing()
+	initTrustedProxies()
+	initAppHosts()
+	initClients()
+	initServiceClients()
+	initLoginStateStore()
+	initAuthorizationCodes()
+	initTokenDenylist()
+
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1])
+		return
+	}
 
-	prefix := "/api/v1/guardian"
+	prefix := apiPrefix
 
 	apiMux := httptrace.NewServeMux(httptrace.WithService("pung-guardian"))
 
@@ -340,11 +415,14 @@ func main() {
 		configMiddlewares(callbackHandler, corsMiddleware))
 
 	apiMux.HandleFunc(prefix+"/logout/{provider}",
-		configMiddlewares(logoutHandler, corsMiddleware))
+		configMiddlewares(logoutHandler, corsMiddleware, authMiddleware))
 
 	apiMux.HandleFunc(prefix+"/auth/{provider}",
 		configMiddlewares(providerAuthHandler, corsMiddleware))
 
+	apiMux.HandleFunc(prefix+"/auth/token",
+		configMiddlewares(postExchangeCode, corsMiddleware))
+
 	apiMux.HandleFunc(prefix+"/auth/refresh",
 		configMiddlewares(putRenewTokens, corsMiddleware))
 
@@ -354,6 +432,57 @@ func main() {
 	apiMux.HandleFunc(prefix+"/register",
 		configMiddlewares(postUserRegister, corsMiddleware, authMiddleware))
 
+	apiMux.HandleFunc(prefix+"/sessions",
+		configMiddlewares(sessionsHandler, corsMiddleware, authMiddleware))
+
+	apiMux.HandleFunc(prefix+"/sessions/{id}",
+		configMiddlewares(sessionHandler, corsMiddleware, authMiddleware))
+
+	apiMux.HandleFunc(prefix+"/identities",
+		configMiddlewares(identitiesHandler, corsMiddleware, authMiddleware))
+
+	apiMux.HandleFunc(prefix+"/identities/{provider}",
+		configMiddlewares(identityHandler, corsMiddleware, authMiddleware))
+
+	apiMux.HandleFunc(prefix+"/service/users/{id}/providers/{provider}/token",
+		configMiddlewares(getProviderToken, serviceAuthMiddleware))
+
+	apiMux.HandleFunc(prefix+"/oauth/authorize",
+		configMiddlewares(oauthAuthorizeHandler))
+
+	apiMux.HandleFunc(prefix+"/oauth/token",
+		configMiddlewares(oauthTokenHandler, clientCorsMiddleware))
+
+	apiMux.HandleFunc(prefix+"/oauth/device_authorization",
+		configMiddlewares(deviceAuthorizationHandler, corsMiddleware))
+
+	apiMux.HandleFunc(prefix+"/oauth/device",
+		configMiddlewares(deviceVerificationHandler))
+
+	apiMux.HandleFunc(prefix+"/introspect",
+		configMiddlewares(introspectionHandler))
+
+	apiMux.HandleFunc(prefix+"/revoke",
+		configMiddlewares(revocationHandler, corsMiddleware))
+
+	apiMux.HandleFunc(prefix+"/admin/clients",
+		configMiddlewares(adminClientsHandler, adminMiddleware, corsMiddleware, authMiddleware))
+
+	apiMux.HandleFunc(prefix+"/admin/clients/{id}",
+		configMiddlewares(adminClientHandler, adminMiddleware, corsMiddleware, authMiddleware))
+
+	apiMux.HandleFunc(prefix+"/admin/clients/{id}/secret",
+		configMiddlewares(adminClientSecretHandler, adminMiddleware, corsMiddleware, authMiddleware))
+
+	apiMux.HandleFunc(prefix+"/userinfo",
+		configMiddlewares(userInfoHandler, clientCorsMiddleware, scopeMiddleware(OpenIDScope)))
+
+	apiMux.HandleFunc(prefix+"/.well-known/openid-configuration",
+		configMiddlewares(getOpenIDConfiguration, corsMiddleware))
+
+	apiMux.HandleFunc(prefix+"/.well-known/jwks.json",
+		configMiddlewares(getJWKS, clientCorsMiddleware))
+
 	logger.Info("Starting server", zap.String("port", environments.ServerPort))
 	log.Fatal(http.ListenAndServe(":"+environments.ServerPort, apiMux))
 }
@@ -1,11 +1,50 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"net/http"
+	"strings"
 
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
+type contextKey string
+
+const (
+	claimsContextKey     contextKey = "claims"
+	sessionContextKey    contextKey = "session"
+	cookieAuthContextKey contextKey = "cookie_auth"
+	serviceContextKey    contextKey = "service_client"
+)
+
+func claimsFromContext(ctx context.Context) *jwt.MapClaims {
+	claims, _ := ctx.Value(claimsContextKey).(*jwt.MapClaims)
+	return claims
+}
+
+func sessionFromContext(ctx context.Context) (Session, bool) {
+	session, ok := ctx.Value(sessionContextKey).(Session)
+	return session, ok
+}
+
+func authenticatedWithCookie(r *http.Request) bool {
+	usingCookie, _ := r.Context().Value(cookieAuthContextKey).(bool)
+	return usingCookie
+}
+
+func stringClaim(claims *jwt.MapClaims, name string) string {
+	value, _ := (*claims)[name].(string)
+	return value
+}
+
+func serviceClientFromContext(ctx context.Context) *ServiceClient {
+	client, _ := ctx.Value(serviceContextKey).(*ServiceClient)
+	return client
+}
+
 func configMiddlewares(handler http.HandlerFunc, middlewares ...func(http.HandlerFunc) http.HandlerFunc) http.HandlerFunc {
 	for _, middleware := range middlewares {
 		handler = middleware(handler)
@@ -13,20 +52,50 @@ func configMiddlewares(handler http.HandlerFunc, middlewares ...func(http.Handle
 	return handler
 }
 
+// authMiddleware protects the first-party routes. Sessions started by OAuth
+// clients are rejected here; they only reach routes behind scopeMiddleware.
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return sessionMiddleware(next, func(session Session) bool {
+		return session.ClientID == ""
+	})
+}
+
+// scopeMiddleware protects the OAuth resource routes: first-party sessions
+// pass, client sessions only when they were granted scope.
+func scopeMiddleware(scope string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return sessionMiddleware(next, func(session Session) bool {
+			return session.ClientID == "" || hasScope(session.Scope, scope)
+		})
+	}
+}
+
+// sessionMiddleware authenticates the access token of a live session and
+// lets it through when allowed accepts the session.
+func sessionMiddleware(next http.HandlerFunc, allowed func(Session) bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		correlationId := r.Header.Get("X-Correlation-Id")
 		logger.Info("Starting | Auth ", zap.String("correlation_id", correlationId))
 		defer logger.Info("Finished | Auth ", zap.String("correlation_id", correlationId))
 
-		if authHeader == "" {
+		token := cookieValue(r, AccessTokenCookie)
+		usingCookie := authHeader == "" && token != ""
+
+		if usingCookie {
+			if !isValidCSRF(r) {
+				logger.Warn("Invalid CSRF token", zap.String("correlation_id", correlationId))
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+		} else if !strings.HasPrefix(authHeader, "Bearer ") {
 			logger.Warn("Invalid Token", zap.String("token", authHeader), zap.String("correlation_id", correlationId))
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
+		} else {
+			token = authHeader[len("Bearer "):]
 		}
 
-		token := authHeader[len("Bearer "):]
 		claims, err := ValidateToken(token, Access)
 
 		if err != nil {
@@ -41,27 +110,65 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-		user := User{}
-
-		err = db.QueryRow(`
-		SELECT id, nickname, email, avatar_url,
-			access_token, refresh_token, status,
-			role, terms_accepted
-		FROM users
-		WHERE id = $1`,
-			id).Scan(&user.ID, &user.NickName, &user.Email, &user.ImgURL,
-			&user.AccessToken, &user.RefreshToken, &user.Status,
-			&user.Role, &user.Terms)
 
+		sessionId, err := uuid.Parse(stringClaim(claims, "sid"))
 		if err != nil {
+			logger.Warn("Token without session", zap.String("correlation_id", correlationId))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		session, err := GetSessionById(sessionId)
+		if err == sql.ErrNoRows {
+			logger.Warn("Session not found", zap.String("session_id", sessionId.String()), zap.String("correlation_id", correlationId))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		} else if err != nil {
 			logger.Error("Error On Database", zap.Error(err), zap.String("correlation_id", correlationId))
 			http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		if *user.AccessToken != token {
-			logger.Warn("Invalid Token", zap.String("token", token), zap.String("correlation_id", correlationId))
-			http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
+		if session.UserID.String() != id || session.RevokedAt != nil ||
+			!matchesTokenHash(session.AccessTokenHash, token) {
+			logger.Warn("Invalid Token", zap.String("session_id", sessionId.String()), zap.String("correlation_id", correlationId))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !allowed(session) {
+			logger.Warn("Session not allowed on route", zap.String("session_id", sessionId.String()),
+				zap.String("client_id", session.ClientID), zap.String("correlation_id", correlationId))
+			w.Header().Set("WWW-Authenticate", `Bearer realm="guardian", error="insufficient_scope"`)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		TouchSession(session.ID)
+
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		ctx = context.WithValue(ctx, sessionContextKey, session)
+		ctx = context.WithValue(ctx, cookieAuthContextKey, usingCookie)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// adminMiddleware runs behind authMiddleware. The role is read from the
+// database rather than the token, so a demotion applies immediately.
+func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		correlationId := r.Header.Get("X-Correlation-Id")
+
+		session, ok := sessionFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		user, err := GetUserByUserId(session.UserID)
+		if err != nil || user.Role != Admin {
+			logger.Warn("Admin route denied", zap.String("user_id", session.UserID.String()), zap.String("correlation_id", correlationId))
+			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
 
@@ -69,16 +176,63 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// serviceAuthMiddleware only lets service clients through; it is for
+// backend-to-backend routes and never accepts user tokens.
+func serviceAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		correlationId := r.Header.Get("X-Correlation-Id")
+
+		client, err := authenticateServiceClient(r)
+		if err != nil {
+			logger.Warn("Invalid service client", zap.String("correlation_id", correlationId), zap.Error(err))
+			w.Header().Set("WWW-Authenticate", `Basic realm="guardian"`)
+			w.Header().Add("WWW-Authenticate", `Bearer realm="guardian"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), serviceContextKey, client)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return withCors(next, false)
+}
+
+// clientCorsMiddleware also lets the origins of registered OAuth clients call
+// the route, without credentials: those clients authenticate with bearer
+// tokens, never with guardian's cookies.
+func clientCorsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return withCors(next, true)
+}
+
+func withCors(next http.HandlerFunc, registeredClients bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		correlationId := r.Header.Get("X-Correlation-Id")
 		logger.Info("Starting | Cors ", zap.String("correlation_id", correlationId))
 		defer logger.Info("Finished | Cors ", zap.String("correlation_id", correlationId))
 
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		// Credentialed requests (cookie delivery) need the exact origin echoed
+		// back; only FRONTEND_CLIENTS origins get them.
+		allowOrigin, allowCredentials := "*", true
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if isOriginAllowed(origin) {
+				allowOrigin = origin
+			} else if registeredClients && registeredClientAllowsOrigin(origin) {
+				allowOrigin, allowCredentials = origin, false
+			}
+			if allowOrigin == origin {
+				w.Header().Add("Vary", "Origin")
+			}
+		}
+
+		if allowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Correlation-Id")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Correlation-Id, "+CSRFTokenHeader)
 		next.ServeHTTP(w, r)
 	}
 }
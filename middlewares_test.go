@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// withTestKeyRing installs a fresh ES256 key as the only signing key.
+func withTestKeyRing(t *testing.T) *SigningKey {
+	t.Helper()
+
+	key, err := GenerateSigningKey(jwt.SigningMethodES256.Alg())
+	if err != nil {
+		t.Fatalf("generate signing key: %v", err)
+	}
+
+	previous := gKeyRing
+	gKeyRing = &KeyRing{
+		active:       key,
+		keys:         map[string]*SigningKey{key.ID: key},
+		legacy:       map[TokenType]*SigningKey{},
+		lastReloaded: time.Now(),
+	}
+	t.Cleanup(func() { gKeyRing = previous })
+	return key
+}
+
+func TestAuthMiddlewareRejectsClientSessions(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		want     int
+	}{
+		{name: "first-party session", clientID: "", want: http.StatusNoContent},
+		{name: "oauth client session", clientID: "partner", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := withTestKeyRing(t)
+			mock := withMockDB(t)
+
+			session := Session{ID: uuid.New(), UserID: uuid.New(), ClientID: tt.clientID}
+			token, err := signToken(key, jwt.MapClaims{
+				"sub":        session.UserID.String(),
+				"sid":        session.ID.String(),
+				"token_type": tokenTypeClaims[Access],
+				"exp":        time.Now().Add(time.Minute).Unix(),
+			})
+			if err != nil {
+				t.Fatalf("sign token: %v", err)
+			}
+			tokenHash := hashToken(token)
+
+			mock.ExpectQuery("FROM sessions").
+				WithArgs(session.ID).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "family_id", "client_id", "scope", "user_agent", "ip_address",
+					"access_token_hash", "refresh_token_hash", "created_at", "last_used_at", "revoked_at"}).
+					AddRow(session.ID, session.UserID, "", session.ClientID, "", "", "",
+						tokenHash, nil, time.Now(), time.Now(), nil))
+			if tt.want == http.StatusNoContent {
+				mock.ExpectExec("UPDATE sessions").WithArgs(session.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			handler := authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/users/me", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("expected status %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+}
+
+func TestCorsCredentialsOnlyForFrontendClients(t *testing.T) {
+	previousClients, previousLogger := gClients, logger
+	gClients = map[string]*Client{"web": {ID: "web", RedirectRules: []RedirectRule{{Exact: "https://app.example.com/callback"}}}}
+	logger = zap.NewNop()
+	t.Cleanup(func() { gClients, logger = previousClients, previousLogger })
+
+	registeredOrigins.Lock()
+	registeredOrigins.rules = []RedirectRule{{Exact: "https://partner.example.com/callback"}}
+	registeredOrigins.loadedAt = time.Now()
+	registeredOrigins.Unlock()
+	t.Cleanup(invalidateRegisteredOrigins)
+
+	tests := []struct {
+		name            string
+		middleware      func(http.HandlerFunc) http.HandlerFunc
+		origin          string
+		wantOrigin      string
+		wantCredentials bool
+	}{
+		{name: "frontend client", middleware: corsMiddleware, origin: "https://app.example.com", wantOrigin: "https://app.example.com", wantCredentials: true},
+		{name: "frontend client on client route", middleware: clientCorsMiddleware, origin: "https://app.example.com", wantOrigin: "https://app.example.com", wantCredentials: true},
+		{name: "registered client", middleware: corsMiddleware, origin: "https://partner.example.com", wantOrigin: "*", wantCredentials: true},
+		{name: "registered client on client route", middleware: clientCorsMiddleware, origin: "https://partner.example.com", wantOrigin: "https://partner.example.com", wantCredentials: false},
+		{name: "unknown origin on client route", middleware: clientCorsMiddleware, origin: "https://evil.example.com", wantOrigin: "*", wantCredentials: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := tt.middleware(func(w http.ResponseWriter, r *http.Request) {})
+
+			req := httptest.NewRequest(http.MethodOptions, "/oauth/token", nil)
+			req.Header.Set("Origin", tt.origin)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Fatalf("expected allowed origin %q, got %q", tt.wantOrigin, got)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Credentials") == "true"; got != tt.wantCredentials {
+				t.Fatalf("expected credentials %v, got %v", tt.wantCredentials, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	urlp "net/url"
+	"slices"
+	"time"
+
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/gothic"
+	"go.uber.org/zap"
+)
+
+// RFC 6749 section 5.2 error codes.
+const (
+	OAuthInvalidRequest          = "invalid_request"
+	OAuthInvalidClient           = "invalid_client"
+	OAuthInvalidGrant            = "invalid_grant"
+	OAuthInvalidScope            = "invalid_scope"
+	OAuthInvalidTarget           = "invalid_target"
+	OAuthUnauthorizedClient      = "unauthorized_client"
+	OAuthUnsupportedGrantType    = "unsupported_grant_type"
+	OAuthUnsupportedResponseType = "unsupported_response_type"
+	OAuthServerError             = "server_error"
+)
+
+type OAuthTokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in"`
+	RefreshToken    string `json:"refresh_token,omitempty"`
+	IDToken         string `json:"id_token,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+type providerChoice struct {
+	Name string
+	URL  string
+}
+
+var providerPickerTemplate = template.Must(template.New("providers").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in</title></head>
+<body>
+<h1>Sign in with</h1>
+<ul>
+{{range .}}<li><a href="{{.URL}}">{{.Name}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="guardian"`)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OAuthErrorResponse{Error: code, ErrorDescription: description})
+}
+
+// redirectOAuthError reports an authorization error to a redirect URI that
+// was already validated for the client, as RFC 6749 section 4.1.2.1 requires.
+func redirectOAuthError(w http.ResponseWriter, r *http.Request, redirectURI, state, code, description string) {
+	http.Redirect(w, r, buildClientRedirect(redirectURI, urlp.Values{
+		"error":             {code},
+		"error_description": {description},
+		"state":             {state},
+	}), http.StatusFound)
+}
+
+func renderProviderPicker(w http.ResponseWriter, r *http.Request) {
+	var choices []providerChoice
+	for _, name := range providerIndex.Providers {
+		query := r.URL.Query()
+		query.Set("provider", name)
+		choices = append(choices, providerChoice{
+			Name: providerIndex.ProvidersMap[name],
+			URL:  r.URL.Path + "?" + query.Encode(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	providerPickerTemplate.Execute(w, choices)
+}
+
+// oauthAuthorizeHandler is the RFC 6749 authorization endpoint. The user
+// signs in through an upstream provider, picked with the optional provider
+// parameter, and the callback answers the client with a PKCE-bound code.
+func oauthAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "oauthAuthorizeHandler"
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	query := r.URL.Query()
+	clientId := query.Get("client_id")
+	client, err := GetClient(clientId)
+	if clientId == "" || err != nil {
+		logger.Warn("Unknown client attempting authorization.", zap.String("client_id", clientId))
+		http.Error(w, "Unknown client.", http.StatusBadRequest)
+		return
+	}
+
+	redirectURI := query.Get("redirect_uri")
+	if _, err := client.ValidateRedirectURI(redirectURI); err != nil {
+		logger.Warn("Unauthorized redirect_uri attempting authorization.",
+			zap.String("client_id", client.ID), zap.String("redirect_uri", redirectURI))
+		http.Error(w, "Unauthorized redirect_uri.", http.StatusBadRequest)
+		return
+	}
+
+	state := query.Get("state")
+	if query.Get("response_type") != "code" {
+		redirectOAuthError(w, r, redirectURI, state, OAuthUnsupportedResponseType, "only response_type=code is supported")
+		return
+	}
+
+	if !client.AllowsGrant(GrantAuthorizationCode) {
+		redirectOAuthError(w, r, redirectURI, state, OAuthUnauthorizedClient, "client may not use the authorization code grant")
+		return
+	}
+
+	scope := query.Get("scope")
+	if !client.AllowsScope(scope) {
+		redirectOAuthError(w, r, redirectURI, state, OAuthInvalidScope, "scope is not registered for this client")
+		return
+	}
+	if err := checkOpenIDScope(scope); err != nil {
+		redirectOAuthError(w, r, redirectURI, state, OAuthInvalidScope, "openid is not available with the current signing key")
+		return
+	}
+
+	codeChallenge := query.Get("code_challenge")
+	if query.Get("code_challenge_method") != "S256" || !isValidCodeChallenge(codeChallenge) {
+		redirectOAuthError(w, r, redirectURI, state, OAuthInvalidRequest, "a S256 code_challenge is required")
+		return
+	}
+
+	provider := query.Get("provider")
+	if provider == "" {
+		renderProviderPicker(w, r)
+		return
+	}
+
+	if _, err := goth.GetProvider(provider); err != nil {
+		redirectOAuthError(w, r, redirectURI, state, OAuthInvalidRequest, "unknown provider")
+		return
+	}
+
+	// gothic would reuse the client's state for the upstream login, so it is
+	// kept out of the request handed to it.
+	upstream := r.Clone(r.Context())
+	upstreamQuery := upstream.URL.Query()
+	upstreamQuery.Del("state")
+	upstream.URL.RawQuery = upstreamQuery.Encode()
+
+	urlStr, err := gothic.GetAuthURL(w, upstream)
+	if err != nil {
+		logger.Error("Error on start upstream login", zap.String("method", method), zap.Error(err))
+		redirectOAuthError(w, r, redirectURI, state, OAuthServerError, "could not start the login")
+		return
+	}
+
+	parsedURL, err := urlp.Parse(urlStr)
+	if err != nil {
+		logger.Error("Failed to parse Auth URL string", zap.Error(err), zap.String("url", urlStr))
+		redirectOAuthError(w, r, redirectURI, state, OAuthServerError, "could not start the login")
+		return
+	}
+
+	err = gLoginStates.Save(parsedURL.Query().Get("state"), LoginState{
+		ClientID:      client.ID,
+		RedirectURL:   redirectURI,
+		CodeChallenge: codeChallenge,
+		Delivery:      OAuthDelivery,
+		ClientState:   state,
+		Scope:         scope,
+		Nonce:         query.Get("nonce"),
+		ExpiresAt:     time.Now().Add(LoginStateLifetime),
+	})
+	if err != nil {
+		redirectOAuthError(w, r, redirectURI, state, OAuthServerError, "could not store the login")
+		return
+	}
+
+	http.Redirect(w, r, urlStr, http.StatusFound)
+}
+
+// oauthTokenHandler is the RFC 6749 token endpoint for the authorization_code,
+// refresh_token and client_credentials grants, the RFC 8628 device_code grant
+// and the RFC 8693 token-exchange grant.
+func oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "oauthTokenHandler"
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, OAuthInvalidRequest, "malformed form body")
+		return
+	}
+
+	client, err := authenticateClient(r)
+	if err != nil {
+		logger.Warn("Client authentication failed", zap.String("method", method), zap.Error(err))
+		writeOAuthError(w, http.StatusUnauthorized, OAuthInvalidClient, "client authentication failed")
+		return
+	}
+
+	grantType := r.PostForm.Get("grant_type")
+	if slices.Contains(supportedGrantTypes, grantType) && !client.AllowsGrant(grantType) {
+		writeOAuthError(w, http.StatusBadRequest, OAuthUnauthorizedClient, "client may not use this grant type")
+		return
+	}
+
+	device := newSessionClient(r)
+	device.ClientID = client.ID
+
+	var tokens ClientTokens
+
+	switch grantType {
+	case GrantAuthorizationCode:
+		code := r.PostForm.Get("code")
+		verifier := r.PostForm.Get("code_verifier")
+		if code == "" || verifier == "" {
+			writeOAuthError(w, http.StatusBadRequest, OAuthInvalidRequest, "code and code_verifier are required")
+			return
+		}
+		tokens, err = ExchangeClientCode(code, verifier, r.PostForm.Get("redirect_uri"), device)
+	case GrantRefreshToken:
+		refreshToken := r.PostForm.Get("refresh_token")
+		if refreshToken == "" {
+			writeOAuthError(w, http.StatusBadRequest, OAuthInvalidRequest, "refresh_token is required")
+			return
+		}
+		tokens, err = RefreshClientSession(refreshToken, device)
+	case GrantClientCredentials:
+		tokens, err = IssueClientToken(client, r.PostForm.Get("scope"), r.PostForm["audience"])
+	case GrantDeviceCode:
+		deviceCode := r.PostForm.Get("device_code")
+		if deviceCode == "" {
+			writeOAuthError(w, http.StatusBadRequest, OAuthInvalidRequest, "device_code is required")
+			return
+		}
+		tokens, err = ExchangeDeviceCode(deviceCode, device)
+	case GrantTokenExchange:
+		subjectToken := r.PostForm.Get("subject_token")
+		if subjectToken == "" {
+			writeOAuthError(w, http.StatusBadRequest, OAuthInvalidRequest, "subject_token is required")
+			return
+		}
+		tokens, err = ExchangeToken(subjectToken, r.PostForm.Get("subject_token_type"), r.PostForm.Get("requested_token_type"),
+			client, r.PostForm["audience"], r.PostForm.Get("scope"))
+	default:
+		writeOAuthError(w, http.StatusBadRequest, OAuthUnsupportedGrantType, "")
+		return
+	}
+
+	if errors.Is(err, ErrUnsupportedTokenType) {
+		writeOAuthError(w, http.StatusBadRequest, OAuthInvalidRequest, err.Error())
+		return
+	} else if errors.Is(err, ErrDeviceAuthorizationPending) {
+		writeOAuthError(w, http.StatusBadRequest, OAuthAuthorizationPending, "")
+		return
+	} else if errors.Is(err, ErrDeviceSlowDown) {
+		writeOAuthError(w, http.StatusBadRequest, OAuthSlowDown, "")
+		return
+	} else if errors.Is(err, ErrDeviceCodeExpired) {
+		writeOAuthError(w, http.StatusBadRequest, OAuthExpiredToken, "")
+		return
+	} else if errors.Is(err, ErrDeviceAccessDenied) {
+		writeOAuthError(w, http.StatusBadRequest, OAuthAccessDenied, "")
+		return
+	} else if errors.Is(err, ErrInvalidScope) {
+		writeOAuthError(w, http.StatusBadRequest, OAuthInvalidScope, "")
+		return
+	} else if errors.Is(err, ErrInvalidTarget) {
+		writeOAuthError(w, http.StatusBadRequest, OAuthInvalidTarget, "")
+		return
+	} else if errors.Is(err, ErrTokenGenerationFailure) || errors.Is(err, ErrTokenUpdateFailure) || errors.Is(err, ErrUnexpectedTokenValidation) {
+		logger.Error("Error on issue tokens", zap.String("method", method), zap.Error(err))
+		writeOAuthError(w, http.StatusInternalServerError, OAuthServerError, "")
+		return
+	} else if err != nil {
+		logger.Warn("Invalid grant", zap.String("method", method), zap.String("client_id", client.ID), zap.Error(err))
+		writeOAuthError(w, http.StatusBadRequest, OAuthInvalidGrant, "")
+		return
+	}
+
+	expiresIn := client.TokenLifetimes().Access
+	if tokens.ExpiresIn > 0 {
+		expiresIn = tokens.ExpiresIn
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	json.NewEncoder(w).Encode(OAuthTokenResponse{
+		AccessToken:     tokens.Pair.AccessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int64(expiresIn.Seconds()),
+		RefreshToken:    tokens.Pair.RefreshToken,
+		IDToken:         tokens.IDToken,
+		Scope:           tokens.Scope,
+		IssuedTokenType: tokens.IssuedTokenType,
+	})
+}
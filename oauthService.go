@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrInvalidScope       = errors.New("scope is not registered for the client")
+	ErrInvalidTarget      = errors.New("audience is not registered for the client")
+	ErrInvalidClientToken = errors.New("token is not a valid client token")
+)
+
+const OpenIDScope = "openid"
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+	GrantDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+	GrantTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// supportedGrantTypes are the grants the token endpoint implements and that
+// clients can be registered for.
+var supportedGrantTypes = []string{GrantAuthorizationCode, GrantRefreshToken, GrantClientCredentials, GrantDeviceCode, GrantTokenExchange}
+
+// confidentialGrantTypes act without a user at the client, so only clients
+// that can authenticate may be registered for them.
+var confidentialGrantTypes = []string{GrantClientCredentials, GrantTokenExchange}
+
+var defaultClientGrantTypes = []string{GrantAuthorizationCode, GrantRefreshToken}
+
+// ClientTokens is what the OAuth token endpoint hands back to a client.
+// Grants that act for the client itself start no session. A zero ExpiresIn
+// means the client's access token lifetime.
+type ClientTokens struct {
+	Session         Session
+	Pair            TokenPair
+	IDToken         string
+	Scope           string
+	IssuedTokenType string
+	ExpiresIn       time.Duration
+}
+
+func hasScope(scope, want string) bool {
+	for _, granted := range strings.Fields(scope) {
+		if granted == want {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOpenIDScope rejects the openid scope while the active signing key is
+// symmetric, before a code or session is spent on a request that cannot get
+// its ID token.
+func checkOpenIDScope(scope string) error {
+	if hasScope(scope, OpenIDScope) && !idTokensSupported() {
+		return fmt.Errorf("%w: %v", ErrInvalidScope, ErrSymmetricIDTokenKey)
+	}
+	return nil
+}
+
+// ExchangeClientCode implements the OAuth authorization_code grant. Besides
+// the PKCE verifier, the client and redirect URI must be the ones the code
+// was issued to through /oauth/authorize.
+func ExchangeClientCode(code, codeVerifier, redirectURI string, client SessionClient) (ClientTokens, error) {
+	authCode, user, err := redeemAuthorizationCode(code, codeVerifier, func(authCode AuthorizationCode) bool {
+		return authCode.Delivery == OAuthDelivery && authCode.ClientID == client.ClientID &&
+			authCode.RedirectURI == redirectURI
+	})
+	if err != nil {
+		return ClientTokens{}, err
+	}
+
+	if err := checkOpenIDScope(authCode.Scope); err != nil {
+		return ClientTokens{}, err
+	}
+
+	client.Scope = authCode.Scope
+	session, pair, err := StartSession(user, client)
+	if err != nil {
+		return ClientTokens{}, err
+	}
+
+	return withIDToken(ClientTokens{Session: session, Pair: pair, Scope: session.Scope}, user, authCode.Nonce)
+}
+
+// RefreshClientSession implements the OAuth refresh_token grant. The client
+// only presents the refresh token, which must belong to a session it started.
+func RefreshClientSession(oldRefresh string, client SessionClient) (ClientTokens, error) {
+	session, pair, err := renewSessionTokens(oldRefresh, nil, client)
+	if err != nil {
+		return ClientTokens{}, err
+	}
+
+	// The refreshed ID token is optional, so a switch to a symmetric key
+	// must not cost the client its rotated refresh token.
+	tokens := ClientTokens{Session: session, Pair: pair, Scope: session.Scope}
+	if !hasScope(session.Scope, OpenIDScope) || !idTokensSupported() {
+		return tokens, nil
+	}
+
+	user, err := GetUserByUserId(session.UserID)
+	if err != nil {
+		return ClientTokens{}, fmt.Errorf("%w: %v", ErrUserNotFound, err)
+	}
+
+	return withIDToken(tokens, user, "")
+}
+
+// IssueClientToken implements the client_credentials grant. The requested
+// scope and audiences must have been registered for the client; without an
+// audience parameter the token is issued for all of the client's audiences.
+func IssueClientToken(client *Client, scope string, audience []string) (ClientTokens, error) {
+	if !client.AllowsScope(scope) {
+		return ClientTokens{}, ErrInvalidScope
+	}
+
+	audience, err := resolveAudience(client, audience)
+	if err != nil {
+		return ClientTokens{}, err
+	}
+
+	scope = strings.Join(strings.Fields(scope), " ")
+	accessToken, err := GenerateClientToken(client, scope, audience)
+	if err != nil {
+		return ClientTokens{}, fmt.Errorf("%w: %v", ErrTokenGenerationFailure, err)
+	}
+
+	return ClientTokens{Pair: TokenPair{AccessToken: accessToken}, Scope: scope}, nil
+}
+
+// resolveAudience checks the requested audiences against the client's
+// registration, defaulting to all of them.
+func resolveAudience(client *Client, audience []string) ([]string, error) {
+	if len(audience) == 0 {
+		audience = client.Audiences
+	}
+	if len(audience) == 0 {
+		return nil, ErrInvalidTarget
+	}
+	for _, aud := range audience {
+		if !client.AllowsAudience(aud) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidTarget, aud)
+		}
+	}
+	return audience, nil
+}
+
+// ValidateClientToken checks a client_credentials token through ValidateToken,
+// like any access token, and then that it was issued to a client for the
+// audience with the scope.
+func ValidateClientToken(token, audience, scope string) (*jwt.MapClaims, error) {
+	claims, err := ValidateToken(token, Access)
+	if err != nil {
+		return nil, err
+	}
+
+	clientId := stringClaim(claims, "client_id")
+	subject, _ := claims.GetSubject()
+	if clientId == "" || subject != clientId || stringClaim(claims, "sid") != "" {
+		return nil, ErrInvalidClientToken
+	}
+
+	audiences, err := claims.GetAudience()
+	if err != nil || !slices.Contains(audiences, audience) {
+		return nil, fmt.Errorf("%w: audience mismatch", ErrInvalidClientToken)
+	}
+
+	if !hasScope(stringClaim(claims, "scope"), scope) {
+		return nil, fmt.Errorf("%w: missing scope %s", ErrInvalidClientToken, scope)
+	}
+
+	return claims, nil
+}
+
+func withIDToken(tokens ClientTokens, user User, nonce string) (ClientTokens, error) {
+	if !hasScope(tokens.Session.Scope, OpenIDScope) {
+		return tokens, nil
+	}
+
+	idToken, err := GenerateIDToken(user, tokens.Session.ClientID, nonce)
+	if err != nil {
+		return ClientTokens{}, fmt.Errorf("%w: %v", ErrTokenGenerationFailure, err)
+	}
+
+	tokens.IDToken = idToken
+	return tokens, nil
+}
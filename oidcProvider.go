@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/markbates/goth"
+	"github.com/markbates/goth/providers/openidConnect"
+	"go.uber.org/zap"
+)
+
+var ErrInvalidIDToken = errors.New("invalid id_token")
+
+const jwksMissReloadInterval = time.Minute
+
+// OIDCProvider is a goth OpenID Connect provider that also verifies the
+// id_token signature against the issuer's published keys.
+type OIDCProvider struct {
+	*openidConnect.Provider
+	settings OIDCProviderSettings
+	jwksURI  string
+
+	sync.RWMutex
+	keys         map[string]JSONWebKey
+	lastReloaded time.Time
+}
+
+type openIDDiscovery struct {
+	Issuer  string `json:"issuer"`
+	JwksURI string `json:"jwks_uri"`
+}
+
+func NewOIDCProvider(settings OIDCProviderSettings) (*OIDCProvider, error) {
+	discoveryURL := settings.Issuer + "/.well-known/openid-configuration"
+	callbackURL := environments.RedirectUrl + apiPrefix + "/auth/" + settings.Name + "/callback"
+
+	provider, err := openidConnect.NewNamed(settings.Name, settings.ClientID, settings.ClientSecret,
+		callbackURL, discoveryURL, settings.Scopes...)
+	if err != nil {
+		return nil, fmt.Errorf("discovery failed for %s: %w", settings.Name, err)
+	}
+	provider.SetName(settings.Name)
+
+	var discovery openIDDiscovery
+	if err := getJSON(discoveryURL, &discovery); err != nil {
+		return nil, fmt.Errorf("discovery failed for %s: %w", settings.Name, err)
+	}
+
+	if discovery.Issuer != settings.Issuer {
+		return nil, fmt.Errorf("issuer mismatch for %s: discovered %s", settings.Name, discovery.Issuer)
+	}
+
+	if discovery.JwksURI == "" {
+		return nil, fmt.Errorf("issuer %s does not publish jwks_uri", settings.Issuer)
+	}
+
+	return &OIDCProvider{
+		Provider: provider,
+		settings: settings,
+		jwksURI:  discovery.JwksURI,
+		keys:     map[string]JSONWebKey{},
+	}, nil
+}
+
+func (p *OIDCProvider) FetchUser(session goth.Session) (goth.User, error) {
+	sess, ok := session.(*openidConnect.Session)
+	if !ok {
+		return goth.User{}, fmt.Errorf("%w: unexpected session type", ErrInvalidIDToken)
+	}
+
+	if err := p.verifyIDToken(sess.IDToken); err != nil {
+		return goth.User{}, err
+	}
+
+	return p.Provider.FetchUser(session)
+}
+
+func (p *OIDCProvider) verifyIDToken(idToken string) error {
+	parseOptions := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(tokenLeeway),
+		jwt.WithIssuer(p.settings.Issuer),
+		jwt.WithAudience(p.settings.ClientID),
+		jwt.WithValidMethods([]string{
+			jwt.SigningMethodRS256.Alg(),
+			jwt.SigningMethodES256.Alg(),
+			jwt.SigningMethodEdDSA.Alg(),
+		}),
+	}
+
+	_, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		jwk, err := p.lookupKey(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		if jwk.Alg != "" && jwk.Alg != token.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return jwk.PublicKey()
+	}, parseOptions...)
+
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	return nil
+}
+
+// lookupKey finds the issuer key by kid, refetching the JWKS when the issuer
+// may have rotated.
+func (p *OIDCProvider) lookupKey(kid string) (JSONWebKey, error) {
+	p.RLock()
+	jwk, found := p.findKey(kid)
+	stale := time.Since(p.lastReloaded) > jwksMissReloadInterval
+	p.RUnlock()
+
+	if found {
+		return jwk, nil
+	}
+	if !stale {
+		return JSONWebKey{}, fmt.Errorf("unknown signing key: %s", kid)
+	}
+
+	var set JSONWebKeySet
+	if err := getJSON(p.jwksURI, &set); err != nil {
+		return JSONWebKey{}, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.keys = map[string]JSONWebKey{}
+	for _, key := range set.Keys {
+		if key.Use == "" || key.Use == "sig" {
+			p.keys[key.Kid] = key
+		}
+	}
+	p.lastReloaded = time.Now()
+
+	jwk, found = p.findKey(kid)
+	if !found {
+		return JSONWebKey{}, fmt.Errorf("unknown signing key: %s", kid)
+	}
+	return jwk, nil
+}
+
+func (p *OIDCProvider) findKey(kid string) (JSONWebKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	jwk, found := p.keys[kid]
+	return jwk, found
+}
+
+func getJSON(url string, target interface{}) error {
+	res, err := providerHTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("GET %s responded with %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(target)
+}
+
+func initOIDCProviders(providers map[string]string) []goth.Provider {
+	var gothProviders []goth.Provider
+
+	for _, settings := range environments.OIDCProviders {
+		if err := settings.Claims.Validate(); err != nil {
+			logger.Error("Error on setup OIDC provider", zap.String("provider", settings.Name), zap.Error(err))
+			continue
+		}
+
+		provider, err := NewOIDCProvider(settings)
+		if err != nil {
+			logger.Error("Error on setup OIDC provider", zap.String("provider", settings.Name), zap.Error(err))
+			continue
+		}
+
+		UserAccount[settings.Name] = settings.Claims
+		providers[settings.Name] = settings.DisplayName
+		gothProviders = append(gothProviders, provider)
+	}
+
+	return gothProviders
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	urlp "net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/markbates/goth/providers/openidConnect"
+)
+
+const mockIssuerClientID = "guardian"
+
+// mockIssuer is a local OpenID Connect issuer serving discovery, JWKS and a
+// token endpoint that answers every code with idToken.
+type mockIssuer struct {
+	*httptest.Server
+	key     *SigningKey
+	idToken string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+
+	key, err := GenerateSigningKey(jwt.SigningMethodRS256.Alg())
+	if err != nil {
+		t.Fatalf("generate issuer key: %v", err)
+	}
+	issuer := &mockIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+			"jwks_uri":               issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk, err := issuer.key.JWK()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(JSONWebKeySet{Keys: []JSONWebKey{jwk}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "provider-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     issuer.idToken,
+		})
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (m *mockIssuer) claims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":   m.URL,
+		"sub":   "provider-user",
+		"aud":   mockIssuerClientID,
+		"email": "user@example.com",
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+}
+
+func (m *mockIssuer) provider(t *testing.T) *OIDCProvider {
+	t.Helper()
+
+	environments = &Environment{RedirectUrl: "http://guardian.test"}
+	provider, err := NewOIDCProvider(OIDCProviderSettings{
+		Name:         "mock",
+		Issuer:       m.URL,
+		ClientID:     mockIssuerClientID,
+		ClientSecret: "secret",
+		Scopes:       []string{"openid", "email"},
+	})
+	if err != nil {
+		t.Fatalf("setup provider: %v", err)
+	}
+	return provider
+}
+
+func TestOIDCProviderVerifiesIDToken(t *testing.T) {
+	issuer := newMockIssuer(t)
+
+	forger, err := GenerateSigningKey(jwt.SigningMethodRS256.Alg())
+	if err != nil {
+		t.Fatalf("generate forged key: %v", err)
+	}
+	forger.ID = issuer.key.ID
+
+	tests := []struct {
+		name   string
+		key    *SigningKey
+		mutate func(jwt.MapClaims)
+		valid  bool
+	}{
+		{name: "valid id_token", key: issuer.key, valid: true},
+		{name: "bad signature", key: forger},
+		{name: "wrong issuer", key: issuer.key, mutate: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{name: "wrong audience", key: issuer.key, mutate: func(c jwt.MapClaims) { c["aud"] = "another-client" }},
+		{name: "expired", key: issuer.key, mutate: func(c jwt.MapClaims) {
+			c["iat"] = time.Now().Add(-2 * time.Hour).Unix()
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := issuer.claims()
+			if tt.mutate != nil {
+				tt.mutate(claims)
+			}
+
+			idToken, err := signToken(tt.key, claims)
+			if err != nil {
+				t.Fatalf("sign id_token: %v", err)
+			}
+			issuer.idToken = idToken
+
+			provider := issuer.provider(t)
+			session := &openidConnect.Session{}
+			if _, err := session.Authorize(provider.Provider, urlp.Values{"code": {"code"}}); err != nil {
+				t.Fatalf("token exchange: %v", err)
+			}
+
+			user, err := provider.FetchUser(session)
+			if tt.valid {
+				if err != nil {
+					t.Fatalf("FetchUser() error = %v", err)
+				}
+				if user.UserID != "provider-user" || user.Email != "user@example.com" {
+					t.Fatalf("FetchUser() = %+v", user)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Fatalf("FetchUser() error = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
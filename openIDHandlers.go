@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	JwksURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+type UserInfoResponse struct {
+	Sub           string  `json:"sub"`
+	Nickname      string  `json:"nickname,omitempty"`
+	Picture       string  `json:"picture,omitempty"`
+	Email         *string `json:"email,omitempty"`
+	EmailVerified *bool   `json:"email_verified,omitempty"`
+}
+
+func getOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	issuer := issuerURL()
+
+	// ID tokens need an asymmetric key, so openid is only advertised with one.
+	scopes := []string{"profile", "email"}
+	var signingAlgorithms []string
+	if key := gKeyRing.Active(); key != nil && !key.IsSymmetric() {
+		scopes = append([]string{OpenIDScope}, scopes...)
+		signingAlgorithms = []string{key.Method.Alg()}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(OpenIDConfiguration{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oauth/authorize",
+		TokenEndpoint:                     issuer + "/oauth/token",
+		DeviceAuthorizationEndpoint:       issuer + "/oauth/device_authorization",
+		UserinfoEndpoint:                  issuer + "/userinfo",
+		IntrospectionEndpoint:             issuer + "/introspect",
+		RevocationEndpoint:                issuer + "/revoke",
+		JwksURI:                           issuer + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               supportedGrantTypes,
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  signingAlgorithms,
+		ScopesSupported:                   scopes,
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "nonce", "nickname", "picture", "email", "email_verified"},
+		TokenEndpointAuthMethodsSupported: []string{"none", "client_secret_basic", "client_secret_post"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+	})
+}
+
+// userInfoHandler serves the OIDC userinfo endpoint for the token subject.
+// OAuth clients only see the claims their granted scope covers; first-party
+// sessions, which carry no scope, see all of them.
+func userInfoHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "userInfoHandler"
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+		return
+	case http.MethodGet, http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	session, _ := sessionFromContext(r.Context())
+	user, err := GetUserByUserId(session.UserID)
+	if err != nil {
+		logger.Error("Error on get user", zap.String("method", method), zap.Error(err))
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	firstParty := session.ClientID == ""
+	response := UserInfoResponse{Sub: user.ID.String()}
+
+	if firstParty || hasScope(session.Scope, "profile") {
+		response.Nickname = user.NickName
+		response.Picture = user.ImgURL
+	}
+
+	if firstParty || hasScope(session.Scope, "email") {
+		response.Email = user.Email
+		response.EmailVerified = &user.EmailVerified
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	urlp "net/url"
+	"strings"
+	"time"
+)
+
+var providerHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// ProviderRevokers revoke an upstream access token at providers that expose a
+// revocation endpoint.
+var ProviderRevokers = map[string]func(token string) error{
+	"github": revokeGithubToken,
+	"google": revokeGoogleToken,
+}
+
+func revokeGithubToken(token string) error {
+	clientId := environments.Auths.ProviderKeys["github"]
+	body, err := json.Marshal(map[string]string{"access_token": token})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodDelete,
+		fmt.Sprintf("https://api.github.com/applications/%s/token", clientId), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(clientId, environments.Auths.ProviderSecrets["github"])
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	return doRevocationRequest(req)
+}
+
+func revokeGoogleToken(token string) error {
+	form := urlp.Values{"token": {token}}
+	req, err := http.NewRequest(http.MethodPost, "https://oauth2.googleapis.com/revoke", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return doRevocationRequest(req)
+}
+
+func doRevocationRequest(req *http.Request) error {
+	res, err := providerHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Providers answer 400/404 for tokens that are already invalid.
+	if res.StatusCode >= 300 && res.StatusCode != http.StatusBadRequest && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("provider revocation failed with status %d", res.StatusCode)
+	}
+	return nil
+}
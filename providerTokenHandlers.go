@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type ProviderTokenResponse struct {
+	AccessToken string     `json:"access_token"`
+	TokenType   string     `json:"token_type"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+func getProviderToken(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "getProviderToken"
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	userId, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	token, err := GetProviderAccessToken(userId, r.PathValue("provider"), serviceClientFromContext(r.Context()))
+	if errors.Is(err, ErrProviderNotAllowed) {
+		logger.Warn("Service client outside its providers", zap.String("method", method), zap.Error(err))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	} else if errors.Is(err, ErrIdentityNotFound) || errors.Is(err, ErrProviderTokenUnavailable) {
+		http.Error(w, "Provider token not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrProviderTokenExpired) {
+		logger.Warn("Provider token cannot be refreshed", zap.String("method", method), zap.Error(err))
+		http.Error(w, "Provider token expired; the user must sign in again", http.StatusConflict)
+		return
+	} else if err != nil {
+		logger.Error("Error on get provider token", zap.String("method", method), zap.Error(err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(ProviderTokenResponse{
+		AccessToken: token.AccessToken,
+		TokenType:   "Bearer",
+		ExpiresAt:   token.ExpiresAt,
+	})
+}
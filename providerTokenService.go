@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/markbates/goth"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrProviderTokenUnavailable = errors.New("no provider token stored for identity")
+	ErrProviderTokenExpired     = errors.New("provider token expired and cannot be refreshed")
+	ErrProviderNotAllowed       = errors.New("service client may not read tokens of this provider")
+)
+
+// providerTokenRefreshMargin refreshes tokens that would expire while the
+// calling service is still using them.
+const providerTokenRefreshMargin = time.Minute
+
+type ProviderToken struct {
+	AccessToken string
+	ExpiresAt   *time.Time
+}
+
+func providerTokenNeedsRefresh(identity Identity) bool {
+	return identity.ProviderTokenExpiresAt != nil &&
+		time.Now().Add(providerTokenRefreshMargin).After(*identity.ProviderTokenExpiresAt)
+}
+
+// GetProviderAccessToken returns a usable upstream token for the user,
+// refreshing it through the goth provider when it is about to expire.
+func GetProviderAccessToken(userId uuid.UUID, providerName string, client *ServiceClient) (ProviderToken, error) {
+	if !client.AllowsProvider(providerName) {
+		return ProviderToken{}, fmt.Errorf("%w: %s", ErrProviderNotAllowed, providerName)
+	}
+
+	identity, err := GetUserIdentity(userId, providerName)
+	if err != nil {
+		return ProviderToken{}, err
+	}
+
+	if identity.ProviderAccessToken == "" {
+		return ProviderToken{}, ErrProviderTokenUnavailable
+	}
+
+	if providerTokenNeedsRefresh(identity) {
+		identity, err = RefreshIdentityProviderTokens(identity.ID, refreshProviderToken)
+		if err != nil {
+			return ProviderToken{}, err
+		}
+	}
+
+	logger.Info("Provider token handed out",
+		zap.String("service_client", client.ID),
+		zap.String("user_id", userId.String()),
+		zap.String("provider", providerName))
+
+	return ProviderToken{
+		AccessToken: identity.ProviderAccessToken,
+		ExpiresAt:   identity.ProviderTokenExpiresAt,
+	}, nil
+}
+
+// refreshProviderToken runs under the identity row lock, so it re-checks the
+// expiry in case another caller refreshed while this one was waiting.
+func refreshProviderToken(identity Identity) (Identity, bool, error) {
+	if !providerTokenNeedsRefresh(identity) {
+		return identity, false, nil
+	}
+
+	provider, err := goth.GetProvider(identity.Provider)
+	if err != nil {
+		return Identity{}, false, err
+	}
+
+	if !provider.RefreshTokenAvailable() || identity.ProviderRefreshToken == nil || *identity.ProviderRefreshToken == "" {
+		return Identity{}, false, ErrProviderTokenExpired
+	}
+
+	token, err := provider.RefreshToken(*identity.ProviderRefreshToken)
+	if err != nil {
+		return Identity{}, false, fmt.Errorf("%w: %v", ErrProviderTokenExpired, err)
+	}
+
+	identity.ProviderAccessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		identity.ProviderRefreshToken = &token.RefreshToken
+	}
+
+	identity.ProviderTokenExpiresAt = nil
+	if !token.Expiry.IsZero() {
+		identity.ProviderTokenExpiresAt = &token.Expiry
+	}
+
+	return identity, true, nil
+}
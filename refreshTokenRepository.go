@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type RefreshTokenState struct {
+	FamilyID  string
+	UserID    uuid.UUID
+	RotatedAt *time.Time
+	RevokedAt *time.Time
+}
+
+func CreateRefreshToken(pair TokenPair, parentJTI *string, userId uuid.UUID) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO refresh_token_families (id, user_id)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING`,
+		pair.FamilyID, userId)
+
+	if err != nil {
+		logger.Error("Error on create refresh token family", zap.Error(err))
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (jti, family_id, parent_jti, expires_at)
+		VALUES ($1, $2, $3, $4)`,
+		pair.RefreshJTI, pair.FamilyID, parentJTI, pair.RefreshExpiresAt)
+
+	if err != nil {
+		logger.Error("Error on create refresh token", zap.Error(err))
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MarkRefreshTokenRotated consumes a refresh token. It reports false when the
+// token was already rotated, its family was revoked, or it does not exist.
+func MarkRefreshTokenRotated(jti string) (bool, error) {
+	result, err := db.Exec(`
+		UPDATE refresh_tokens rt SET
+			rotated_at = NOW()
+		FROM refresh_token_families f
+		WHERE rt.jti = $1
+			AND rt.rotated_at IS NULL
+			AND f.id = rt.family_id
+			AND f.revoked_at IS NULL`,
+		jti)
+
+	if err != nil {
+		logger.Error("Error on rotate refresh token", zap.Error(err))
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+func GetRefreshTokenState(jti string) (RefreshTokenState, error) {
+	var state RefreshTokenState
+
+	err := db.QueryRow(`
+	SELECT f.id, f.user_id, rt.rotated_at, f.revoked_at
+	FROM refresh_tokens rt
+	JOIN refresh_token_families f ON f.id = rt.family_id
+	WHERE rt.jti = $1`,
+		jti).Scan(&state.FamilyID, &state.UserID, &state.RotatedAt, &state.RevokedAt)
+
+	if err != nil && err != sql.ErrNoRows {
+		logger.Error("Error on get refresh token", zap.Error(err))
+	}
+
+	return state, err
+}
+
+// RevokeRefreshTokenFamily also revokes the session that owns the family.
+func RevokeRefreshTokenFamily(familyID string, reason string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE refresh_token_families SET
+			revoked_at = NOW(),
+			revoked_reason = $2
+		WHERE id = $1 AND revoked_at IS NULL`,
+		familyID, reason)
+
+	if err != nil {
+		logger.Error("Error on revoke refresh token family", zap.Error(err))
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE sessions SET
+			revoked_at = NOW()
+		WHERE family_id = $1 AND revoked_at IS NULL`,
+		familyID)
+
+	if err != nil {
+		logger.Error("Error on revoke session", zap.Error(err))
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// revocationHandler is the RFC 7009 revocation endpoint. It answers 200 for
+// unknown or already invalid tokens, so callers cannot probe for them.
+func revocationHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "revocationHandler"
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, OAuthInvalidRequest, "malformed form body")
+		return
+	}
+
+	client, err := authenticateClient(r)
+	if err != nil {
+		logger.Warn("Client authentication failed", zap.String("method", method), zap.Error(err))
+		writeOAuthError(w, http.StatusUnauthorized, OAuthInvalidClient, "client authentication failed")
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeOAuthError(w, http.StatusBadRequest, OAuthInvalidRequest, "token is required")
+		return
+	}
+
+	err = RevokeToken(token, tokenTypeHints[r.PostForm.Get("token_type_hint")], client)
+	if errors.Is(err, ErrTokenNotOwned) {
+		logger.Warn("Client revoking a token it does not own", zap.String("method", method), zap.String("client_id", client.ID))
+		writeOAuthError(w, http.StatusBadRequest, OAuthUnauthorizedClient, "token was not issued to this client")
+		return
+	} else if err != nil {
+		logger.Error("Error on revoke token", zap.String("method", method), zap.Error(err))
+		writeOAuthError(w, http.StatusServiceUnavailable, OAuthServerError, "")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
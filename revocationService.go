@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+var ErrTokenNotOwned = errors.New("token was not issued to this client")
+
+const TokenRevokedByClient = "revoked_by_client"
+
+// clientOwnsToken matches the token's client against the caller. First-party
+// tokens carry no client and belong to the FRONTEND_CLIENTS applications.
+func clientOwnsToken(client *Client, tokenClientId string) bool {
+	if tokenClientId == "" {
+		_, configured := gClients[client.ID]
+		return configured
+	}
+	return tokenClientId == client.ID
+}
+
+// RevokeToken implements RFC 7009. The token's jti is denylisted until it
+// expires, and revoking a refresh token also ends its session. Tokens that are
+// invalid, expired or already revoked need no work and are not errors, but a
+// token that could not be checked is: the client must retry.
+func RevokeToken(token string, hint TokenType, client *Client) error {
+	claims, tokenType, err := ValidateAnyToken(token, hint)
+	if err != nil || claims == nil {
+		return err
+	}
+
+	tokenClientId := stringClaim(claims, "client_id")
+	var session *Session
+
+	if sessionId := stringClaim(claims, "sid"); sessionId != "" {
+		sessionUUID, err := uuid.Parse(sessionId)
+		if err != nil {
+			return nil
+		}
+
+		found, err := GetSessionById(sessionUUID)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		session = &found
+
+		// Delegated tokens belong to the client they were exchanged for.
+		if _, delegated := (*claims)["act"]; !delegated {
+			tokenClientId = session.ClientID
+		}
+	}
+
+	if !clientOwnsToken(client, tokenClientId) {
+		return ErrTokenNotOwned
+	}
+
+	if err := denyToken(claims); err != nil {
+		return err
+	}
+
+	if tokenType == Refresh && session != nil {
+		return RevokeRefreshTokenFamily(session.FamilyID, TokenRevokedByClient)
+	}
+	return nil
+}
+
+func denyToken(claims *jwt.MapClaims) error {
+	jti := stringClaim(claims, "jti")
+	if jti == "" {
+		return nil
+	}
+
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		return nil
+	}
+
+	return gTokenDenylist.Revoke(jti, expiresAt.Time)
+}
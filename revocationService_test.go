@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func TestRevokeTokenReportsDenylistFailures(t *testing.T) {
+	key := withTestKeyRing(t)
+	mock := withMockDB(t)
+
+	previousDenylist := gTokenDenylist
+	gTokenDenylist = &TokenDenylist{entries: map[string]denylistEntry{}}
+	t.Cleanup(func() { gTokenDenylist = previousDenylist })
+
+	token, err := signToken(key, jwt.MapClaims{
+		"sub":        "web",
+		"client_id":  "web",
+		"jti":        uuid.New().String(),
+		"token_type": tokenTypeClaims[Access],
+		"exp":        time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+
+	// A failed lookup must not pass for an invalid token, which is answered 200.
+	mock.ExpectQuery("FROM revoked_tokens").WillReturnError(errors.New("connection refused"))
+
+	err = RevokeToken(token, Access, &Client{ID: "web"})
+	if !errors.Is(err, ErrUnexpectedTokenValidation) {
+		t.Fatalf("expected ErrUnexpectedTokenValidation, got %v", err)
+	}
+}
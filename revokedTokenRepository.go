@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func CreateRevokedToken(jti string, expiresAt time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO revoked_tokens (jti, expires_at)
+		VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING`,
+		jti, expiresAt)
+
+	if err != nil {
+		logger.Error("Error on create revoked token", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func IsRevokedToken(jti string) (bool, error) {
+	var found int
+
+	err := db.QueryRow(`SELECT 1 FROM revoked_tokens WHERE jti = $1`, jti).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		logger.Error("Error on get revoked token", zap.Error(err))
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DeleteExpiredRevokedTokens drops entries for tokens that would be rejected
+// as expired anyway.
+func DeleteExpiredRevokedTokens() (int64, error) {
+	result, err := db.Exec(`DELETE FROM revoked_tokens WHERE expires_at <= $1`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
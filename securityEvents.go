@@ -0,0 +1,12 @@
+package main
+
+import "go.uber.org/zap"
+
+const (
+	RefreshTokenReuseDetected = "refresh_token_reuse_detected"
+)
+
+// emitSecurityEvent logs events that should be picked up by alerting.
+func emitSecurityEvent(event string, fields ...zap.Field) {
+	logger.Warn("Security Event", append([]zap.Field{zap.String("security_event", event)}, fields...)...)
+}
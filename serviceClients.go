@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var ErrInvalidServiceClient = errors.New("invalid service client credentials")
+
+// ServiceAPIScope lets a client_credentials token call the service-to-service
+// API; the token's audience must be this server's issuer.
+const ServiceAPIScope = "guardian:service"
+
+// anyProvider in a service client's provider list grants every provider.
+const anyProvider = "*"
+
+// ServiceClient is a backend allowed to call the service-to-service API for
+// the users' identities at its providers.
+type ServiceClient struct {
+	ID         string
+	SecretHash [32]byte
+	Providers  []string
+}
+
+var gServiceClients = map[string]*ServiceClient{}
+
+// initServiceClients reads SERVICE_CLIENTS, formatted as
+// "billing=secret:google|github;reports=secret:*". Without it no service
+// client is accepted.
+func initServiceClients() {
+	clientsStr := os.Getenv("SERVICE_CLIENTS")
+	if clientsStr == "" {
+		return
+	}
+
+	clients, err := parseServiceClients(clientsStr)
+	if err != nil {
+		logger.Fatal("Setup Project Error | Invalid SERVICE_CLIENTS", zap.Error(err))
+	}
+	gServiceClients = clients
+}
+
+func parseServiceClients(clientsStr string) (map[string]*ServiceClient, error) {
+	clients := map[string]*ServiceClient{}
+
+	for _, entry := range strings.Split(clientsStr, ";") {
+		id, credentials, found := strings.Cut(strings.TrimSpace(entry), "=")
+		// The provider list follows the last colon; secrets may contain colons.
+		separator := strings.LastIndex(credentials, ":")
+		if !found || id == "" || separator < 1 || separator == len(credentials)-1 {
+			return nil, fmt.Errorf("invalid service client entry for %q: expected id=secret:providers", id)
+		}
+
+		secret, providers := credentials[:separator], strings.Split(credentials[separator+1:], "|")
+		clients[id] = &ServiceClient{ID: id, SecretHash: sha256.Sum256([]byte(secret)), Providers: providers}
+	}
+
+	return clients, nil
+}
+
+func (c *ServiceClient) AllowsProvider(provider string) bool {
+	return slices.Contains(c.Providers, anyProvider) || slices.Contains(c.Providers, provider)
+}
+
+// authenticateServiceClient accepts a client_credentials bearer token or HTTP
+// Basic credentials of a SERVICE_CLIENTS entry. A token only counts when its
+// client is listed there too: the scope alone is registry data, not a grant.
+// Secrets are compared by hash so the comparison time does not depend on
+// their length.
+func authenticateServiceClient(r *http.Request) (*ServiceClient, error) {
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		claims, err := ValidateClientToken(token, issuerURL(), ServiceAPIScope)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidServiceClient, err)
+		}
+
+		client, found := gServiceClients[stringClaim(claims, "client_id")]
+		if !found {
+			return nil, fmt.Errorf("%w: %s is not a service client", ErrInvalidServiceClient, stringClaim(claims, "client_id"))
+		}
+		return client, nil
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrInvalidServiceClient
+	}
+
+	client, found := gServiceClients[id]
+	secretHash := sha256.Sum256([]byte(secret))
+	if !found || subtle.ConstantTimeCompare(client.SecretHash[:], secretHash[:]) != 1 {
+		return nil, ErrInvalidServiceClient
+	}
+	return client, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+func TestParseServiceClients(t *testing.T) {
+	clients, err := parseServiceClients("billing=s3:cr3t:google|github;reports=secret:*")
+	if err != nil {
+		t.Fatalf("parse service clients: %v", err)
+	}
+
+	billing := clients["billing"]
+	if billing == nil || !billing.AllowsProvider("google") || !billing.AllowsProvider("github") || billing.AllowsProvider("keycloak") {
+		t.Fatalf("billing should be limited to google and github, got %+v", billing)
+	}
+	if clients["reports"] == nil || !clients["reports"].AllowsProvider("keycloak") {
+		t.Fatalf("reports should be allowed every provider")
+	}
+
+	for _, invalid := range []string{"billing=secret", "billing=secret:", "billing=:google", "=secret:google"} {
+		if _, err := parseServiceClients(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestServiceTokenNeedsServiceClientEntry(t *testing.T) {
+	key := withTestKeyRing(t)
+
+	previousEnvironments, previousLogger, previousClients := environments, logger, gServiceClients
+	environments = &Environment{RedirectUrl: "http://guardian.test"}
+	logger = zap.NewNop()
+	gServiceClients = map[string]*ServiceClient{"billing": {ID: "billing", Providers: []string{"google"}}}
+	t.Cleanup(func() { environments, logger, gServiceClients = previousEnvironments, previousLogger, previousClients })
+
+	for _, tt := range []struct {
+		clientID string
+		want     error
+	}{
+		{clientID: "billing"},
+		{clientID: "partner", want: ErrInvalidServiceClient},
+	} {
+		t.Run(tt.clientID, func(t *testing.T) {
+			token, err := signToken(key, jwt.MapClaims{
+				"sub":        tt.clientID,
+				"client_id":  tt.clientID,
+				"aud":        []string{issuerURL()},
+				"scope":      ServiceAPIScope,
+				"token_type": tokenTypeClaims[Access],
+				"exp":        time.Now().Add(time.Minute).Unix(),
+			})
+			if err != nil {
+				t.Fatalf("sign token: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/service/users/id/providers/google/token", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			client, err := authenticateServiceClient(req)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+			if tt.want == nil && client != gServiceClients[tt.clientID] {
+				t.Fatalf("expected the configured service client, got %+v", client)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type SessionResponse struct {
+	ID         uuid.UUID `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current"`
+}
+
+type RevokedSessionsResponse struct {
+	Revoked int64 `json:"revoked"`
+}
+
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "sessionsHandler"
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	current, _ := sessionFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		sessions, err := ListSessions(current.UserID)
+		if err != nil {
+			logger.Error("Error on list sessions", zap.String("method", method), zap.Error(err))
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		response := make([]SessionResponse, 0, len(sessions))
+		for _, session := range sessions {
+			response = append(response, SessionResponse{
+				ID:         session.ID,
+				UserAgent:  session.UserAgent,
+				IPAddress:  session.IPAddress,
+				CreatedAt:  session.CreatedAt,
+				LastUsedAt: session.LastUsedAt,
+				Current:    session.ID == current.ID,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	case http.MethodDelete:
+		revoked, err := RevokeOtherSessions(current)
+		if err != nil {
+			logger.Error("Error on revoke sessions", zap.String("method", method), zap.Error(err))
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(RevokedSessionsResponse{Revoked: revoked})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	correlationId := r.Header.Get("X-Correlation-Id")
+	method := "sessionHandler"
+
+	logger.Info("Starting Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+	defer logger.Info("Finished Process", zap.String("http:method", r.Method), zap.String("method", method), zap.String("correlation_id", correlationId))
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		sessionId, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid session id", http.StatusBadRequest)
+			return
+		}
+
+		current, _ := sessionFromContext(r.Context())
+		err = RevokeSession(current.UserID, sessionId)
+		if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionNotOwned) {
+			logger.Warn("Session not found", zap.String("method", method), zap.Error(err))
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			logger.Error("Error on revoke session", zap.String("method", method), zap.Error(err))
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
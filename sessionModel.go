@@ -0,0 +1,38 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Session struct {
+	ID               uuid.UUID  `json:"id"`
+	UserID           uuid.UUID  `json:"user_id"`
+	FamilyID         string     `json:"-"`
+	ClientID         string     `json:"client_id"`
+	Scope            string     `json:"scope"`
+	UserAgent        string     `json:"user_agent"`
+	IPAddress        string     `json:"ip_address"`
+	AccessTokenHash  *string    `json:"-"`
+	RefreshTokenHash *string    `json:"-"`
+	CreatedAt        time.Time  `json:"created_at"`
+	LastUsedAt       time.Time  `json:"last_used_at"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (s *Session) setTokenHashes(pair TokenPair) {
+	accessTokenHash := hashToken(pair.AccessToken)
+	refreshTokenHash := hashToken(pair.RefreshToken)
+	s.AccessTokenHash = &accessTokenHash
+	s.RefreshTokenHash = &refreshTokenHash
+}
+
+// SessionClient describes who a session is issued to: the device and, for
+// OAuth clients, the client application and granted scope.
+type SessionClient struct {
+	UserAgent string
+	IPAddress string
+	ClientID  string
+	Scope     string
+}
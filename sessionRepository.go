@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+func CreateSession(session Session) error {
+	_, err := db.Exec(`
+		INSERT INTO sessions (id, user_id, family_id, client_id, scope,
+			user_agent, ip_address, access_token_hash, refresh_token_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		session.ID, session.UserID, session.FamilyID, session.ClientID, session.Scope,
+		session.UserAgent, session.IPAddress, session.AccessTokenHash, session.RefreshTokenHash)
+
+	if err != nil {
+		logger.Error("Error on create session", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func GetSessionById(sessionId uuid.UUID) (Session, error) {
+	var session Session
+
+	err := db.QueryRow(`
+	SELECT id, user_id, family_id, client_id, scope, user_agent, ip_address,
+		access_token_hash, refresh_token_hash, created_at, last_used_at, revoked_at
+	FROM sessions
+	WHERE id = $1`,
+		sessionId).Scan(&session.ID, &session.UserID, &session.FamilyID, &session.ClientID, &session.Scope, &session.UserAgent, &session.IPAddress,
+		&session.AccessTokenHash, &session.RefreshTokenHash, &session.CreatedAt, &session.LastUsedAt, &session.RevokedAt)
+
+	if err != nil {
+		logger.Error("Error on get session", zap.Error(err))
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+func UpdateSessionTokens(session Session) error {
+	_, err := db.Exec(`
+		UPDATE sessions SET
+			family_id = $1,
+			access_token_hash = $2,
+			refresh_token_hash = $3,
+			last_used_at = NOW()
+		WHERE id = $4`,
+		session.FamilyID, session.AccessTokenHash, session.RefreshTokenHash, session.ID)
+
+	if err != nil {
+		logger.Error("Error on update session tokens", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// TouchSession records activity, writing at most once a minute per session.
+func TouchSession(sessionId uuid.UUID) error {
+	_, err := db.Exec(`
+		UPDATE sessions SET
+			last_used_at = NOW()
+		WHERE id = $1 AND last_used_at < NOW() - INTERVAL '1 minute'`,
+		sessionId)
+
+	if err != nil {
+		logger.Error("Error on touch session", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func GetActiveSessionsByUserId(userId uuid.UUID) ([]Session, error) {
+	rows, err := db.Query(`
+	SELECT id, user_id, family_id, user_agent, ip_address,
+		created_at, last_used_at
+	FROM sessions
+	WHERE user_id = $1 AND revoked_at IS NULL
+	ORDER BY last_used_at DESC`,
+		userId)
+
+	if err != nil {
+		logger.Error("Error on get sessions", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.ID, &session.UserID, &session.FamilyID, &session.UserAgent, &session.IPAddress,
+			&session.CreatedAt, &session.LastUsedAt)
+		if err != nil {
+			logger.Error("Error on scan session", zap.Error(err))
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeOtherUserSessions revokes every active session of the user except
+// keepSessionId, together with their refresh token families.
+func RevokeOtherUserSessions(userId, keepSessionId uuid.UUID, reason string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE refresh_token_families SET
+			revoked_at = NOW(),
+			revoked_reason = $3
+		WHERE revoked_at IS NULL AND id IN (
+			SELECT family_id FROM sessions
+			WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL)`,
+		userId, keepSessionId, reason)
+
+	if err != nil {
+		logger.Error("Error on revoke refresh token families", zap.Error(err))
+		return 0, err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE sessions SET
+			revoked_at = NOW()
+		WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL`,
+		userId, keepSessionId)
+
+	if err != nil {
+		logger.Error("Error on revoke sessions", zap.Error(err))
+		return 0, err
+	}
+
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return revoked, tx.Commit()
+}
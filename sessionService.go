@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrSessionNotOwned = errors.New("session does not belong to user")
+)
+
+const (
+	SessionRevokedByUser = "revoked_by_user"
+	SessionLoggedOut     = "logout"
+)
+
+func ListSessions(userId uuid.UUID) ([]Session, error) {
+	return GetActiveSessionsByUserId(userId)
+}
+
+func RevokeSession(userId, sessionId uuid.UUID) error {
+	session, err := GetSessionById(sessionId)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %v", ErrSessionNotFound, err)
+	} else if err != nil {
+		return err
+	}
+
+	if session.UserID != userId {
+		return ErrSessionNotOwned
+	}
+
+	if session.RevokedAt != nil {
+		return nil
+	}
+
+	return RevokeRefreshTokenFamily(session.FamilyID, SessionRevokedByUser)
+}
+
+func RevokeOtherSessions(current Session) (int64, error) {
+	return RevokeOtherUserSessions(current.UserID, current.ID, SessionRevokedByUser)
+}
+
+// Logout revokes the current session and, when asked, the upstream provider
+// token. Provider revocation is best effort and never fails the logout.
+func Logout(session Session, provider string, revokeProvider bool) (LogoutResponse, error) {
+	err := RevokeRefreshTokenFamily(session.FamilyID, SessionLoggedOut)
+	if err != nil {
+		return LogoutResponse{}, err
+	}
+
+	response := LogoutResponse{LoggedOut: true}
+	if !revokeProvider {
+		return response, nil
+	}
+
+	revoked, err := revokeProviderToken(session.UserID, provider)
+	if err != nil {
+		logger.Warn("Error on revoke provider token", zap.String("provider", provider), zap.Error(err))
+	}
+	response.ProviderRevoked = revoked
+
+	return response, nil
+}
+
+func revokeProviderToken(userId uuid.UUID, provider string) (bool, error) {
+	revoke, ok := ProviderRevokers[provider]
+	if !ok {
+		return false, nil
+	}
+
+	identity, err := GetUserIdentity(userId, provider)
+	if errors.Is(err, ErrIdentityNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if identity.ProviderAccessToken == "" {
+		return false, nil
+	}
+
+	if err := revoke(identity.ProviderAccessToken); err != nil {
+		return false, err
+	}
+
+	if err := ClearIdentityProviderTokens(identity.ID); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
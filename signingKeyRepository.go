@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// GetValidSigningKeys loads the active and not yet expired keys. A key that
+// cannot be decrypted or decoded fails the whole load, so a reload keeps the
+// previous ring instead of silently dropping a key.
+func GetValidSigningKeys() ([]*SigningKey, error) {
+	rows, err := db.Query(`
+	SELECT id, algorithm, private_key, status, created_at, expires_at
+	FROM signing_keys
+	WHERE status = $1 OR expires_at > NOW()`,
+		ActiveKey)
+
+	if err != nil {
+		logger.Error("Error on get signing keys", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*SigningKey
+	for rows.Next() {
+		var kid, algorithm, stored string
+		var status SigningKeyStatus
+		var createdAt time.Time
+		var expiresAt *time.Time
+
+		if err := rows.Scan(&kid, &algorithm, &stored, &status, &createdAt, &expiresAt); err != nil {
+			logger.Error("Error on scan signing key", zap.Error(err))
+			return nil, err
+		}
+
+		material, err := gTokenCipher.Decrypt(stored)
+		if err != nil {
+			logger.Error("Error on decrypt signing key", zap.Error(err), zap.String("kid", kid))
+			return nil, err
+		}
+
+		key, err := UnmarshalSigningKey(kid, algorithm, material)
+		if err != nil {
+			logger.Error("Error on decode signing key", zap.Error(err), zap.String("kid", kid))
+			return nil, err
+		}
+		key.Status = status
+		key.CreatedAt = createdAt
+		key.ExpiresAt = expiresAt
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// encryptSigningKey seals the private key material with the token cipher, so
+// reading the database is not enough to forge tokens.
+func encryptSigningKey(key *SigningKey) (string, error) {
+	material, err := key.MarshalPrivateKey()
+	if err != nil {
+		return "", err
+	}
+	return gTokenCipher.Encrypt(material)
+}
+
+func InsertSigningKey(key *SigningKey) error {
+	material, err := encryptSigningKey(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO signing_keys (id, algorithm, private_key, status)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO NOTHING`,
+		key.ID, key.Method.Alg(), material, ActiveKey)
+
+	if isUniqueViolation(err) {
+		return ErrActiveSigningKeyExists
+	}
+	if err != nil {
+		logger.Error("Error on insert signing key", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func ReplaceActiveSigningKey(key *SigningKey, retiredUntil time.Time) error {
+	material, err := encryptSigningKey(key)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE signing_keys SET
+			status = $1,
+			retired_at = NOW(),
+			expires_at = $2
+		WHERE status = $3`,
+		RetiredKey, retiredUntil, ActiveKey)
+
+	if err != nil {
+		logger.Error("Error on retire signing key", zap.Error(err))
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO signing_keys (id, algorithm, private_key, status)
+		VALUES ($1, $2, $3, $4)`,
+		key.ID, key.Method.Alg(), material, ActiveKey)
+
+	if err != nil {
+		logger.Error("Error on insert signing key", zap.Error(err))
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type storedSigningKey struct {
+	ID         string
+	PrivateKey string
+}
+
+func GetStoredSigningKeys() ([]storedSigningKey, error) {
+	rows, err := db.Query(`SELECT id, private_key FROM signing_keys`)
+	if err != nil {
+		logger.Error("Error on list stored signing keys", zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []storedSigningKey
+	for rows.Next() {
+		var stored storedSigningKey
+		if err := rows.Scan(&stored.ID, &stored.PrivateKey); err != nil {
+			logger.Error("Error on scan stored signing key", zap.Error(err))
+			return nil, err
+		}
+		keys = append(keys, stored)
+	}
+
+	return keys, rows.Err()
+}
+
+// ReplaceStoredSigningKey only writes when the row still holds the value that
+// was read.
+func ReplaceStoredSigningKey(previous storedSigningKey, privateKey string) (bool, error) {
+	result, err := db.Exec(`
+		UPDATE signing_keys SET private_key = $1
+		WHERE id = $2 AND private_key = $3`,
+		privateKey, previous.ID, previous.PrivateKey)
+
+	if err != nil {
+		logger.Error("Error on replace stored signing key", zap.Error(err))
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	return updated == 1, err
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
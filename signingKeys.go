@@ -0,0 +1,537 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrUnsupportedSigningAlgorithm = errors.New("unsupported token signing algorithm")
+	ErrSigningKeyMismatch          = errors.New("signing key does not match the configured algorithm")
+	ErrActiveSigningKeyExists      = errors.New("an active signing key already exists")
+	ErrSigningSecretRequired       = errors.New("NEXT_ACCESS_TOKEN_SECRET is required to rotate an HS256 key")
+)
+
+type SigningKey struct {
+	ID         string
+	Method     jwt.SigningMethod
+	PrivateKey interface{}
+	PublicKey  interface{}
+	Status     SigningKeyStatus
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+}
+
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+type SigningKeyStatus string
+
+const (
+	ActiveKey  SigningKeyStatus = "active"
+	RetiredKey SigningKeyStatus = "retired"
+)
+
+var supportedSigningAlgorithms = []string{
+	jwt.SigningMethodHS256.Alg(),
+	jwt.SigningMethodRS256.Alg(),
+	jwt.SigningMethodES256.Alg(),
+	jwt.SigningMethodEdDSA.Alg(),
+}
+
+const keyRingReloadInterval = time.Minute
+const keyRingMissReloadInterval = 10 * time.Second
+
+// KeyRing holds every key that may still verify a token. New tokens are
+// signed with the active key; retired keys verify until their last token expires.
+type KeyRing struct {
+	sync.RWMutex
+	active       *SigningKey
+	keys         map[string]*SigningKey
+	legacy       map[TokenType]*SigningKey
+	lastReloaded time.Time
+}
+
+var gKeyRing = &KeyRing{
+	keys:   map[string]*SigningKey{},
+	legacy: map[TokenType]*SigningKey{},
+}
+
+func initKeyRing() {
+	legacyAccess, err := loadSigningKey(environments.TokenSigningSettings)
+	if err != nil {
+		logger.Fatal("Setup Project Error | Invalid token signing key", zap.Error(err))
+	}
+	refreshSecret := []byte(environments.RefreshTokenSecret)
+	gKeyRing.legacy[Access] = legacyAccess
+	gKeyRing.legacy[Refresh] = &SigningKey{Method: jwt.SigningMethodHS256, PrivateKey: refreshSecret, PublicKey: refreshSecret}
+
+	if err := gKeyRing.Reload(); err != nil {
+		logger.Fatal("Setup Project Error | Could not load signing keys", zap.Error(err))
+	}
+
+	if gKeyRing.Active() == nil {
+		logger.Info("No active signing key found, creating the first one.")
+		if err := bootstrapSigningKey(legacyAccess); err != nil {
+			logger.Fatal("Setup Project Error | Could not create signing key", zap.Error(err))
+		}
+		if err := gKeyRing.Reload(); err != nil {
+			logger.Fatal("Setup Project Error | Could not load signing keys", zap.Error(err))
+		}
+	}
+
+	go reloadKeyRingPeriodically()
+}
+
+func reloadKeyRingPeriodically() {
+	ticker := time.NewTicker(keyRingReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := gKeyRing.Reload(); err != nil {
+			logger.Error("Error on reload signing keys", zap.Error(err))
+		}
+	}
+}
+
+// bootstrapSigningKey seeds the ring with the configured key: the key file, or
+// ACCESS_TOKEN_SECRET in HS256 mode, which the services verifying our tokens
+// share.
+func bootstrapSigningKey(configured *SigningKey) error {
+	key := configured
+	if configured.IsSymmetric() {
+		key = newSymmetricSigningKey(configured.PrivateKey.([]byte))
+	}
+
+	err := InsertSigningKey(key)
+	if errors.Is(err, ErrActiveSigningKeyExists) {
+		// Another replica won the race.
+		return nil
+	}
+	return err
+}
+
+func (r *KeyRing) Reload() error {
+	keys, err := GetValidSigningKeys()
+	if err != nil {
+		return err
+	}
+
+	ring := map[string]*SigningKey{}
+	var active *SigningKey
+	for _, key := range keys {
+		ring[key.ID] = key
+		if key.Status == ActiveKey {
+			active = key
+		}
+	}
+
+	r.Lock()
+	r.keys = ring
+	r.active = active
+	r.lastReloaded = time.Now()
+	r.Unlock()
+	return nil
+}
+
+func (r *KeyRing) Active() *SigningKey {
+	r.RLock()
+	defer r.RUnlock()
+	return r.active
+}
+
+func (r *KeyRing) Legacy(tt TokenType) *SigningKey {
+	r.RLock()
+	defer r.RUnlock()
+	return r.legacy[tt]
+}
+
+// Lookup finds a key by kid, reloading once if another replica rotated recently.
+func (r *KeyRing) Lookup(kid string) *SigningKey {
+	r.RLock()
+	key, found := r.keys[kid]
+	stale := time.Since(r.lastReloaded) > keyRingMissReloadInterval
+	r.RUnlock()
+
+	if found || !stale {
+		return key
+	}
+
+	if err := r.Reload(); err != nil {
+		logger.Error("Error on reload signing keys", zap.Error(err))
+		return nil
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+	return r.keys[kid]
+}
+
+func (r *KeyRing) PublicKeys() []*SigningKey {
+	r.RLock()
+	defer r.RUnlock()
+
+	var keys []*SigningKey
+	for _, key := range r.keys {
+		if !key.IsSymmetric() {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys
+}
+
+// RotateSigningKey creates a new active key and retires the current one, which
+// keeps verifying until every token it signed has expired. An HS256 key is
+// never generated: nextSecret must be the secret the verifying services were
+// given.
+func RotateSigningKey(nextSecret string) (*SigningKey, error) {
+	algorithm := environments.TokenSigningSettings.Algorithm
+
+	var key *SigningKey
+	if algorithm == jwt.SigningMethodHS256.Alg() {
+		if nextSecret == "" {
+			return nil, ErrSigningSecretRequired
+		}
+		key = newSymmetricSigningKey([]byte(nextSecret))
+	} else {
+		var err error
+		key, err = GenerateSigningKey(algorithm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	retiredUntil := time.Now().Add(RefreshTokenLifetime + tokenLeeway)
+	if err := ReplaceActiveSigningKey(key, retiredUntil); err != nil {
+		return nil, err
+	}
+
+	if err := gKeyRing.Reload(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// GenerateSigningKey creates a new asymmetric key; HS256 secrets always come
+// from the operator.
+func GenerateSigningKey(algorithm string) (*SigningKey, error) {
+	var privateKey crypto.Signer
+	var err error
+
+	switch algorithm {
+	case jwt.SigningMethodRS256.Alg():
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedSigningAlgorithm, algorithm)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	return newSigningKey(algorithm, privateKey)
+}
+
+// newSymmetricSigningKey wraps an HS256 secret; it has no public part to
+// derive a thumbprint kid from, so it gets a random one.
+func newSymmetricSigningKey(secret []byte) *SigningKey {
+	return &SigningKey{
+		ID:         uuid.New().String(),
+		Method:     jwt.SigningMethodHS256,
+		PrivateKey: secret,
+		PublicKey:  secret,
+	}
+}
+
+func loadSigningKey(settings TokenSigningSettings) (*SigningKey, error) {
+	if settings.Algorithm == jwt.SigningMethodHS256.Alg() {
+		secret := []byte(environments.AccessTokenSecret)
+		return &SigningKey{
+			Method:     jwt.SigningMethodHS256,
+			PrivateKey: secret,
+			PublicKey:  secret,
+		}, nil
+	}
+
+	pemBytes, err := os.ReadFile(settings.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key file: %w", err)
+	}
+
+	privateKey, err := parsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSigningKey(settings.Algorithm, privateKey)
+}
+
+// MarshalPrivateKey encodes the key material for storage: PKCS#8 PEM for
+// asymmetric keys, base64 for HMAC secrets.
+func (k *SigningKey) MarshalPrivateKey() (string, error) {
+	if secret, ok := k.PrivateKey.([]byte); ok {
+		return base64.StdEncoding.EncodeToString(secret), nil
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(k.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+func UnmarshalSigningKey(kid, algorithm, material string) (*SigningKey, error) {
+	if algorithm == jwt.SigningMethodHS256.Alg() {
+		secret, err := base64.StdEncoding.DecodeString(material)
+		if err != nil {
+			return nil, err
+		}
+		return &SigningKey{ID: kid, Method: jwt.SigningMethodHS256, PrivateKey: secret, PublicKey: secret}, nil
+	}
+
+	privateKey, err := parsePrivateKey([]byte(material))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := newSigningKey(algorithm, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	key.ID = kid
+	return key, nil
+}
+
+func parsePrivateKey(pemBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("signing key is not PEM encoded")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("signing key of type %T cannot sign", key)
+	}
+	return signer, nil
+}
+
+func newSigningKey(algorithm string, privateKey crypto.Signer) (*SigningKey, error) {
+	var method jwt.SigningMethod
+
+	switch algorithm {
+	case jwt.SigningMethodRS256.Alg():
+		if _, ok := privateKey.(*rsa.PrivateKey); !ok {
+			return nil, ErrSigningKeyMismatch
+		}
+		method = jwt.SigningMethodRS256
+	case jwt.SigningMethodES256.Alg():
+		ecKey, ok := privateKey.(*ecdsa.PrivateKey)
+		if !ok || ecKey.Curve != elliptic.P256() {
+			return nil, ErrSigningKeyMismatch
+		}
+		method = jwt.SigningMethodES256
+	case jwt.SigningMethodEdDSA.Alg():
+		if _, ok := privateKey.(ed25519.PrivateKey); !ok {
+			return nil, ErrSigningKeyMismatch
+		}
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedSigningAlgorithm, algorithm)
+	}
+
+	key := &SigningKey{
+		Method:     method,
+		PrivateKey: privateKey,
+		PublicKey:  privateKey.Public(),
+	}
+
+	kid, err := key.Thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	key.ID = kid
+
+	return key, nil
+}
+
+func (k *SigningKey) IsSymmetric() bool {
+	_, ok := k.Method.(*jwt.SigningMethodHMAC)
+	return ok
+}
+
+func (k *SigningKey) JWK() (JSONWebKey, error) {
+	jwk := JSONWebKey{
+		Kid: k.ID,
+		Use: "sig",
+		Alg: k.Method.Alg(),
+	}
+
+	switch pub := k.PublicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		ecdhKey, err := pub.ECDH()
+		if err != nil {
+			return JSONWebKey{}, err
+		}
+		// Uncompressed point: 0x04 || X || Y
+		point := ecdhKey.Bytes()[1:]
+		size := len(point) / 2
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(point[:size])
+		jwk.Y = base64.RawURLEncoding.EncodeToString(point[size:])
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	default:
+		return JSONWebKey{}, fmt.Errorf("public key of type %T cannot be published", k.PublicKey)
+	}
+
+	return jwk, nil
+}
+
+// PublicKey decodes a published JWK back into a verification key.
+func (jwk JSONWebKey) PublicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != elliptic.P256().Params().Name {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if jwk.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+// Thumbprint computes the RFC 7638 thumbprint of the public key, used as its kid.
+func (k *SigningKey) Thumbprint() (string, error) {
+	jwk, err := k.JWK()
+	if err != nil {
+		return "", err
+	}
+
+	var members interface{}
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+
+	encoded, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(encoded)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func PublicKeySet() JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range gKeyRing.PublicKeys() {
+		jwk, err := key.JWK()
+		if err != nil {
+			logger.Error("Error on build JWK", zap.Error(err), zap.String("kid", key.ID))
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"time"
+)
+
+type TokenDelivery string
+
+const (
+	CodeDelivery   TokenDelivery = "code"
+	CookieDelivery TokenDelivery = "cookie"
+	OAuthDelivery  TokenDelivery = "oauth"
+	DeviceDelivery TokenDelivery = "device"
+)
+
+const (
+	AccessTokenCookie  = "guardian_access_token"
+	RefreshTokenCookie = "guardian_refresh_token"
+	CSRFTokenCookie    = "guardian_csrf"
+	CSRFTokenHeader    = "X-CSRF-Token"
+)
+
+var sameSiteModes = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+func newTokenCookie(name, value, path string, lifetime time.Duration, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   environments.CookieSettings.Domain,
+		MaxAge:   int(lifetime.Seconds()),
+		Secure:   true,
+		HttpOnly: httpOnly,
+		SameSite: sameSiteModes[environments.CookieSettings.SameSite],
+	}
+}
+
+// setTokenCookies delivers the tokens as HttpOnly cookies together with a
+// readable CSRF token the frontend must echo in the X-CSRF-Token header.
+func setTokenCookies(w http.ResponseWriter, tokens UserTokenResponse) error {
+	csrf := make([]byte, 32)
+	if _, err := rand.Read(csrf); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, newTokenCookie(AccessTokenCookie, tokens.AccessToken, apiPrefix, AccessTokenLifetime, true))
+	http.SetCookie(w, newTokenCookie(RefreshTokenCookie, tokens.RefreshToken, apiPrefix+"/auth/refresh", RefreshTokenLifetime, true))
+	http.SetCookie(w, newTokenCookie(CSRFTokenCookie, base64.RawURLEncoding.EncodeToString(csrf), "/", RefreshTokenLifetime, false))
+	return nil
+}
+
+func clearTokenCookies(w http.ResponseWriter) {
+	http.SetCookie(w, newTokenCookie(AccessTokenCookie, "", apiPrefix, -time.Second, true))
+	http.SetCookie(w, newTokenCookie(RefreshTokenCookie, "", apiPrefix+"/auth/refresh", -time.Second, true))
+	http.SetCookie(w, newTokenCookie(CSRFTokenCookie, "", "/", -time.Second, false))
+}
+
+func cookieValue(r *http.Request, name string) string {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// isValidCSRF applies the double-submit check to state-changing requests.
+func isValidCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	cookie := cookieValue(r, CSRFTokenCookie)
+	header := r.Header.Get(CSRFTokenHeader)
+	if cookie == "" || header == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) == 1
+}
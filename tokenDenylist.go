@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// Replicas learn about revocations made elsewhere within denylistCacheTTL;
+// revocations made locally apply immediately.
+const denylistCacheTTL = 30 * time.Second
+
+type denylistEntry struct {
+	revoked    bool
+	validUntil time.Time
+}
+
+// TokenDenylist answers "was this jti revoked" from memory when it can, so
+// ValidateToken does not hit the database for every request.
+type TokenDenylist struct {
+	sync.RWMutex
+	entries map[string]denylistEntry
+}
+
+var gTokenDenylist = &TokenDenylist{entries: map[string]denylistEntry{}}
+
+func initTokenDenylist() {
+	go cleanupTokenDenylist()
+}
+
+func cleanupTokenDenylist() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		gTokenDenylist.prune()
+
+		deleted, err := DeleteExpiredRevokedTokens()
+		if err != nil {
+			logger.Error("Error on clean up revoked tokens", zap.Error(err))
+			continue
+		}
+		logger.Debug("Cleaned up revoked tokens.", zap.Int64("deleted", deleted))
+	}
+}
+
+// IsRevoked looks the jti up. A revoked answer is kept until the token expires;
+// a clean one only for denylistCacheTTL.
+func (d *TokenDenylist) IsRevoked(jti string, expiresAt time.Time) (bool, error) {
+	d.RLock()
+	entry, found := d.entries[jti]
+	d.RUnlock()
+
+	now := time.Now()
+	if found && now.Before(entry.validUntil) {
+		return entry.revoked, nil
+	}
+
+	revoked, err := IsRevokedToken(jti)
+	if err != nil {
+		return false, err
+	}
+
+	validUntil := expiresAt.Add(tokenLeeway)
+	if !revoked && now.Add(denylistCacheTTL).Before(validUntil) {
+		validUntil = now.Add(denylistCacheTTL)
+	}
+
+	d.Lock()
+	d.entries[jti] = denylistEntry{revoked: revoked, validUntil: validUntil}
+	d.Unlock()
+
+	return revoked, nil
+}
+
+// Revoke denies the jti until the token would have expired on its own.
+func (d *TokenDenylist) Revoke(jti string, expiresAt time.Time) error {
+	validUntil := expiresAt.Add(tokenLeeway)
+	if err := CreateRevokedToken(jti, validUntil); err != nil {
+		return err
+	}
+
+	d.Lock()
+	d.entries[jti] = denylistEntry{revoked: true, validUntil: validUntil}
+	d.Unlock()
+
+	return nil
+}
+
+func (d *TokenDenylist) prune() {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	for jti, entry := range d.entries {
+		if now.After(entry.validUntil) {
+			delete(d.entries, jti)
+		}
+	}
+}
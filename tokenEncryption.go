@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrUnknownEncryptionKey = errors.New("unknown token encryption key")
+	ErrInvalidCiphertext    = errors.New("invalid encrypted token")
+)
+
+// Encrypted values look like "enc:v1:<kid>:<wrapped data key>:<sealed token>".
+// Each value gets its own data key, sealed with the master key <kid>, so a
+// master key rotation only has to rewrap the data keys. Values without the
+// prefix are plaintext written before encryption was enabled.
+const encryptedTokenPrefix = "enc:v1:"
+
+type TokenCipher struct {
+	masterKeys  map[string]cipher.AEAD
+	activeKeyID string
+}
+
+var gTokenCipher *TokenCipher
+
+// initTokenEncryption reads TOKEN_ENCRYPTION_KEYS ("kid:base64key,...", 32
+// byte keys) and TOKEN_ENCRYPTION_ACTIVE_KEY, which defaults to the first kid.
+func initTokenEncryption() {
+	tokenCipher, err := parseTokenCipher(environments.TokenEncryption)
+	if err != nil {
+		logger.Fatal("Setup Project Error | Invalid TOKEN_ENCRYPTION_KEYS", zap.Error(err))
+	}
+	gTokenCipher = tokenCipher
+}
+
+func parseTokenCipher(settings TokenEncryptionSettings) (*TokenCipher, error) {
+	tokenCipher := &TokenCipher{masterKeys: map[string]cipher.AEAD{}, activeKeyID: settings.ActiveKeyID}
+
+	for _, entry := range strings.Split(settings.Keys, ",") {
+		kid, encoded, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found || kid == "" {
+			return nil, fmt.Errorf("invalid key entry %q", entry)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 bytes of base64", kid)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		tokenCipher.masterKeys[kid] = aead
+
+		if tokenCipher.activeKeyID == "" {
+			tokenCipher.activeKeyID = kid
+		}
+	}
+
+	if _, ok := tokenCipher.masterKeys[tokenCipher.activeKeyID]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEncryptionKey, tokenCipher.activeKeyID)
+	}
+	return tokenCipher, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealWithKey(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openWithKey(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrInvalidCiphertext
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func (c *TokenCipher) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealedToken, err := sealWithKey(dataAEAD, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return c.wrap(c.activeKeyID, dataKey, sealedToken)
+}
+
+func (c *TokenCipher) wrap(kid string, dataKey, sealedToken []byte) (string, error) {
+	wrappedKey, err := sealWithKey(c.masterKeys[kid], dataKey, []byte(kid))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedTokenPrefix + kid + ":" +
+		base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealedToken), nil
+}
+
+// unwrap returns the master key id, the data key and the sealed token.
+func (c *TokenCipher) unwrap(stored string) (string, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(stored, encryptedTokenPrefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, ErrInvalidCiphertext
+	}
+
+	kid := parts[0]
+	masterKey, ok := c.masterKeys[kid]
+	if !ok {
+		return "", nil, nil, fmt.Errorf("%w: %s", ErrUnknownEncryptionKey, kid)
+	}
+
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, ErrInvalidCiphertext
+	}
+
+	sealedToken, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, ErrInvalidCiphertext
+	}
+
+	dataKey, err := openWithKey(masterKey, wrappedKey, []byte(kid))
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("%w: %v", ErrInvalidCiphertext, err)
+	}
+	return kid, dataKey, sealedToken, nil
+}
+
+func (c *TokenCipher) Decrypt(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedTokenPrefix) {
+		return stored, nil
+	}
+
+	_, dataKey, sealedToken, err := c.unwrap(stored)
+	if err != nil {
+		return "", err
+	}
+
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := openWithKey(dataAEAD, sealedToken, nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidCiphertext, err)
+	}
+	return string(plaintext), nil
+}
+
+// Reencrypt brings a stored value under the active master key. Encrypted
+// values only get their data key rewrapped; plaintext values are encrypted.
+// The second result reports whether the value changed.
+func (c *TokenCipher) Reencrypt(stored string) (string, bool, error) {
+	if stored == "" {
+		return stored, false, nil
+	}
+
+	if !strings.HasPrefix(stored, encryptedTokenPrefix) {
+		encrypted, err := c.Encrypt(stored)
+		return encrypted, err == nil, err
+	}
+
+	kid, dataKey, sealedToken, err := c.unwrap(stored)
+	if err != nil {
+		return "", false, err
+	}
+	if kid == c.activeKeyID {
+		return stored, false, nil
+	}
+
+	rewrapped, err := c.wrap(c.activeKeyID, dataKey, sealedToken)
+	return rewrapped, err == nil, err
+}
+
+func encryptProviderToken(token *string) (*string, error) {
+	if token == nil {
+		return nil, nil
+	}
+
+	encrypted, err := gTokenCipher.Encrypt(*token)
+	if err != nil {
+		return nil, err
+	}
+	return &encrypted, nil
+}
+
+func decryptProviderToken(token *string) (*string, error) {
+	if token == nil {
+		return nil, nil
+	}
+
+	decrypted, err := gTokenCipher.Decrypt(*token)
+	if err != nil {
+		return nil, err
+	}
+	return &decrypted, nil
+}
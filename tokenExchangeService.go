@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrInvalidSubjectToken  = errors.New("subject token is not an active user access token")
+	ErrUnsupportedTokenType = errors.New("only access tokens can be exchanged")
+)
+
+// RFC 8693 section 3 token type identifier.
+const TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+// ExchangeToken implements the RFC 8693 token-exchange grant: the client
+// trades a user's access token for one restricted to its registered
+// audiences. The new token never gets more scope than the subject token, nor
+// outlives it, and its act claim records the client on top of any earlier
+// delegation.
+func ExchangeToken(subjectToken, subjectTokenType, requestedTokenType string, client *Client, audience []string, scope string) (ClientTokens, error) {
+	if subjectTokenType != TokenTypeAccessToken ||
+		(requestedTokenType != "" && requestedTokenType != TokenTypeAccessToken) {
+		return ClientTokens{}, ErrUnsupportedTokenType
+	}
+
+	subject, err := IntrospectToken(subjectToken, Access)
+	if err != nil {
+		return ClientTokens{}, fmt.Errorf("%w: %v", ErrUnexpectedTokenValidation, err)
+	}
+	if !subject.Active || subject.TokenUse != Access || subject.UserStatus == nil {
+		return ClientTokens{}, ErrInvalidSubjectToken
+	}
+
+	audience, err = resolveAudience(client, audience)
+	if err != nil {
+		return ClientTokens{}, err
+	}
+
+	if scope == "" {
+		scope = subject.Scope
+	}
+	scope = strings.Join(strings.Fields(scope), " ")
+	if !client.AllowsScope(scope) {
+		return ClientTokens{}, ErrInvalidScope
+	}
+	if err := checkOpenIDScope(scope); err != nil {
+		return ClientTokens{}, err
+	}
+
+	// First-party tokens carry no scope and stand for the user's full access.
+	if subject.Scope != "" {
+		for _, requested := range strings.Fields(scope) {
+			if !hasScope(subject.Scope, requested) {
+				return ClientTokens{}, fmt.Errorf("%w: %s exceeds the subject token", ErrInvalidScope, requested)
+			}
+		}
+	}
+
+	userId, err := uuid.Parse(subject.Subject)
+	if err != nil {
+		return ClientTokens{}, ErrInvalidSubjectToken
+	}
+
+	user, err := GetUserByUserId(userId)
+	if err != nil {
+		return ClientTokens{}, fmt.Errorf("%w: %v", ErrUserNotFound, err)
+	}
+
+	actor := map[string]any{"sub": client.ID}
+	if subject.Actor != nil {
+		actor["act"] = subject.Actor
+	}
+
+	expiresAt := time.Now().Add(client.TokenLifetimes().Access).Truncate(time.Second)
+	if subjectExpiresAt := time.Unix(subject.ExpiresAt, 0); subjectExpiresAt.Before(expiresAt) {
+		expiresAt = subjectExpiresAt
+	}
+
+	// A subject token still inside the validation leeway would hand out a
+	// token that is already expired.
+	expiresIn := time.Until(expiresAt).Truncate(time.Second)
+	if expiresIn < time.Second {
+		return ClientTokens{}, fmt.Errorf("%w: it expires in less than a second", ErrInvalidSubjectToken)
+	}
+
+	accessToken, err := GenerateDelegatedToken(user, subject.SessionID, client, audience, scope, actor, expiresAt)
+	if err != nil {
+		return ClientTokens{}, fmt.Errorf("%w: %v", ErrTokenGenerationFailure, err)
+	}
+
+	logger.Info("Token exchanged",
+		zap.String("client_id", client.ID),
+		zap.String("user_id", user.ID.String()),
+		zap.Strings("audience", audience),
+		zap.String("scope", scope))
+
+	return ClientTokens{
+		Pair:            TokenPair{AccessToken: accessToken},
+		Scope:           scope,
+		IssuedTokenType: TokenTypeAccessToken,
+		ExpiresIn:       expiresIn,
+	}, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func TestExchangeTokenClampsToSubjectExpiry(t *testing.T) {
+	client := &Client{ID: "reports", Audiences: []string{"billing"}, AccessTokenLifetime: time.Hour}
+
+	previousEnvironments := environments
+	environments = &Environment{RedirectUrl: "http://guardian.test"}
+	t.Cleanup(func() { environments = previousEnvironments })
+
+	tests := []struct {
+		name        string
+		subjectLeft time.Duration
+		wantErr     error
+	}{
+		{name: "subject outlives the client lifetime", subjectLeft: 2 * time.Hour},
+		{name: "subject expires first", subjectLeft: 10 * time.Minute},
+		{name: "subject inside the leeway", subjectLeft: -2 * time.Second, wantErr: ErrInvalidSubjectToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := withTestKeyRing(t)
+			mock := withMockDB(t)
+
+			user := User{ID: uuid.New(), NickName: "octocat", Status: Active}
+			sessionId := uuid.New()
+			subjectExpiresAt := time.Now().Add(tt.subjectLeft)
+			subjectToken, err := signToken(key, jwt.MapClaims{
+				"sub":        user.ID.String(),
+				"sid":        sessionId.String(),
+				"token_type": tokenTypeClaims[Access],
+				"exp":        subjectExpiresAt.Unix(),
+			})
+			if err != nil {
+				t.Fatalf("sign token: %v", err)
+			}
+
+			mock.ExpectQuery("FROM sessions").
+				WithArgs(sessionId).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "family_id", "client_id", "scope", "user_agent", "ip_address",
+					"access_token_hash", "refresh_token_hash", "created_at", "last_used_at", "revoked_at"}).
+					AddRow(sessionId, user.ID, "", "", "", "", "", hashToken(subjectToken), nil, time.Now(), time.Now(), nil))
+			for range 2 {
+				mock.ExpectQuery("FROM users").
+					WithArgs(user.ID).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "nickname", "email", "avatar_url", "access_token_hash",
+						"refresh_token_hash", "status", "role", "terms_accepted", "email_verified"}).
+						AddRow(user.ID, user.NickName, nil, "", nil, nil, user.Status, 0, true, false))
+			}
+
+			tokens, err := ExchangeToken(subjectToken, TokenTypeAccessToken, "", client, nil, "")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("exchange token: %v", err)
+			}
+
+			claims := jwt.MapClaims{}
+			if _, _, err := jwt.NewParser().ParseUnverified(tokens.Pair.AccessToken, claims); err != nil {
+				t.Fatalf("parse exchanged token: %v", err)
+			}
+			exp, _ := claims.GetExpirationTime()
+			if exp.After(subjectExpiresAt) {
+				t.Fatalf("exchanged token expires at %v, after the subject token at %v", exp, subjectExpiresAt)
+			}
+			if tokens.ExpiresIn < time.Second || time.Now().Add(tokens.ExpiresIn).After(exp.Time) {
+				t.Fatalf("expires_in %v does not match exp %v", tokens.ExpiresIn, exp)
+			}
+		})
+	}
+}
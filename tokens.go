@@ -1,6 +1,10 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"time"
@@ -8,38 +12,200 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func GenerateTokens(user User) (string, string, error) {
+const (
+	AccessTokenLifetime  = time.Hour
+	RefreshTokenLifetime = time.Hour * 24 * 7
+	tokenLeeway          = 5 * time.Second
+	IDTokenLifetime      = time.Hour
+)
+
+// TokenLifetimes bounds the tokens of one session; registered OAuth clients
+// may override the defaults.
+type TokenLifetimes struct {
+	Access  time.Duration
+	Refresh time.Duration
+}
+
+var defaultTokenLifetimes = TokenLifetimes{
+	Access:  AccessTokenLifetime,
+	Refresh: RefreshTokenLifetime,
+}
+
+var ErrSymmetricIDTokenKey = errors.New("id tokens need an asymmetric signing key")
+
+// issuerURL is the OpenID issuer identifier and the base of every endpoint
+// published in the discovery document.
+func issuerURL() string {
+	return environments.RedirectUrl + apiPrefix
+}
+
+// hashToken is the only form in which issued tokens are persisted.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func matchesTokenHash(storedHash *string, token string) bool {
+	if storedHash == nil || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(*storedHash), []byte(hashToken(token))) == 1
+}
+
+func signToken(key *SigningKey, claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
+}
+
+type TokenPair struct {
+	AccessToken      string
+	RefreshToken     string
+	RefreshJTI       string
+	FamilyID         string
+	RefreshExpiresAt time.Time
+}
+
+// GenerateTokens signs a new access/refresh pair bound to the session. The
+// refresh token joins the session's family, or starts a new one keyed by its
+// own jti when the session has none yet.
+func GenerateTokens(user User, session Session, lifetimes TokenLifetimes) (TokenPair, error) {
+	key := gKeyRing.Active()
+	if key == nil {
+		return TokenPair{}, fmt.Errorf("no active signing key")
+	}
 
-	accessClaims := jwt.MapClaims{
+	accessClaims := userAccessClaims(user, session.ID, time.Now().Add(lifetimes.Access))
+	signedAccessToken, err := signToken(key, accessClaims)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refreshJTI := uuid.New().String()
+	familyID := session.FamilyID
+	if familyID == "" {
+		familyID = refreshJTI
+	}
+	refreshExpiresAt := time.Now().Add(lifetimes.Refresh).UTC()
+
+	refreshClaims := jwt.MapClaims{
+		"sub":        user.ID,
+		"exp":        refreshExpiresAt.Unix(),
+		"iat":        time.Now().UTC().Unix(),
+		"jti":        refreshJTI,
+		"sid":        session.ID,
+		"fam":        familyID,
+		"token_type": "refresh",
+	}
+	signedRefreshToken, err := signToken(key, refreshClaims)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:      signedAccessToken,
+		RefreshToken:     signedRefreshToken,
+		RefreshJTI:       refreshJTI,
+		FamilyID:         familyID,
+		RefreshExpiresAt: refreshExpiresAt,
+	}, nil
+}
+
+func userAccessClaims(user User, sessionId uuid.UUID, expiresAt time.Time) jwt.MapClaims {
+	return jwt.MapClaims{
 		"sub":        user.ID,
 		"role":       user.Role,
 		"nickname":   user.NickName,
 		"status":     user.Status,
-		"exp":        time.Now().Add(time.Hour).UTC().Unix(),
+		"exp":        expiresAt.UTC().Unix(),
 		"iat":        time.Now().UTC().Unix(),
 		"jti":        uuid.New().String(),
+		"sid":        sessionId,
 		"token_type": "access",
 	}
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-	signedAccessToken, err := accessToken.SignedString([]byte(environments.AccessTokenSecret))
-	if err != nil {
-		return "", "", err
+}
+
+// GenerateDelegatedToken issues the RFC 8693 token a client gets in exchange
+// for a user's access token. It carries the user's claims and session, so it
+// dies with the session, but is restricted to the audience and scope, and the
+// act claim names the client acting for the user.
+func GenerateDelegatedToken(user User, sessionId uuid.UUID, client *Client, audience []string, scope string, actor map[string]any, expiresAt time.Time) (string, error) {
+	key := gKeyRing.Active()
+	if key == nil {
+		return "", fmt.Errorf("no active signing key")
 	}
 
-	refreshClaims := jwt.MapClaims{
-		"sub":        user.ID,
-		"exp":        time.Now().Add(time.Hour * 24 * 7).UTC().Unix(),
+	claims := userAccessClaims(user, sessionId, expiresAt)
+	claims["iss"] = issuerURL()
+	claims["aud"] = audience
+	claims["scope"] = scope
+	claims["client_id"] = client.ID
+	claims["act"] = actor
+
+	return signToken(key, claims)
+}
+
+// GenerateClientToken issues a client_credentials access token. Following
+// RFC 9068, the client is its own subject, and the absence of a session tells
+// it apart from user tokens.
+func GenerateClientToken(client *Client, scope string, audience []string) (string, error) {
+	key := gKeyRing.Active()
+	if key == nil {
+		return "", fmt.Errorf("no active signing key")
+	}
+
+	claims := jwt.MapClaims{
+		"iss":        issuerURL(),
+		"sub":        client.ID,
+		"client_id":  client.ID,
+		"aud":        audience,
+		"scope":      scope,
+		"exp":        time.Now().Add(client.TokenLifetimes().Access).UTC().Unix(),
 		"iat":        time.Now().UTC().Unix(),
 		"jti":        uuid.New().String(),
-		"token_type": "refresh",
+		"token_type": "access",
 	}
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
-	signedRefreshToken, err := refreshToken.SignedString([]byte(environments.RefreshTokenSecret))
-	if err != nil {
-		return "", "", err
+
+	return signToken(key, claims)
+}
+
+// idTokensSupported reports whether the active key can sign ID tokens, which
+// clients verify with the published public key.
+func idTokensSupported() bool {
+	key := gKeyRing.Active()
+	return key != nil && !key.IsSymmetric()
+}
+
+// GenerateIDToken issues an OpenID Connect ID token for the client. Clients
+// verify it against the JWKS, so HMAC keys, which are never published, cannot
+// sign it.
+func GenerateIDToken(user User, clientId, nonce string) (string, error) {
+	key := gKeyRing.Active()
+	if key == nil {
+		return "", fmt.Errorf("no active signing key")
+	}
+	if key.IsSymmetric() {
+		return "", ErrSymmetricIDTokenKey
+	}
+
+	claims := jwt.MapClaims{
+		"iss":            issuerURL(),
+		"sub":            user.ID,
+		"aud":            clientId,
+		"exp":            time.Now().Add(IDTokenLifetime).UTC().Unix(),
+		"iat":            time.Now().UTC().Unix(),
+		"nickname":       user.NickName,
+		"picture":        user.ImgURL,
+		"email_verified": user.EmailVerified,
+	}
+	if user.Email != nil {
+		claims["email"] = *user.Email
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
 	}
 
-	return signedAccessToken, signedRefreshToken, nil
+	return signToken(key, claims)
 }
 
 type TokenType string
@@ -49,27 +215,34 @@ const (
 	Refresh TokenType = "refreshToken"
 )
 
-func ValidateToken(tokenString string, tt TokenType) (*jwt.MapClaims, error) {
-	var secret = []byte(environments.AccessTokenSecret)
-	if tt == Refresh {
-		secret = []byte(environments.RefreshTokenSecret)
-	}
-
-	if len(secret) == 0 {
-		return nil, fmt.Errorf("missing secret key")
-	}
+var tokenTypeClaims = map[TokenType]string{
+	Access:  "access",
+	Refresh: "refresh",
+}
 
+func ValidateToken(tokenString string, tt TokenType) (*jwt.MapClaims, error) {
 	parseOptions := []jwt.ParserOption{
 		jwt.WithExpirationRequired(),
-		jwt.WithLeeway(5 * time.Second),
-		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}),
+		jwt.WithLeeway(tokenLeeway),
+		jwt.WithValidMethods(supportedSigningAlgorithms),
 	}
 
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		var key *SigningKey
+		if kid, ok := token.Header["kid"].(string); ok && kid != "" {
+			key = gKeyRing.Lookup(kid)
+		} else {
+			// Tokens issued before the key ring carry no kid.
+			key = gKeyRing.Legacy(tt)
+		}
+
+		if key == nil {
+			return nil, fmt.Errorf("unknown signing key: %v", token.Header["kid"])
+		}
+		if token.Method.Alg() != key.Method.Alg() {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return secret, nil
+		return key.PublicKey, nil
 	}, parseOptions...)
 
 	if err != nil {
@@ -80,5 +253,42 @@ func ValidateToken(tokenString string, tt TokenType) (*jwt.MapClaims, error) {
 	if !ok || !token.Valid {
 		return nil, fmt.Errorf("invalid claims")
 	}
+
+	if tokenType, _ := claims["token_type"].(string); tokenType != tokenTypeClaims[tt] {
+		return nil, fmt.Errorf("invalid token type: %v", claims["token_type"])
+	}
+
+	// Tokens issued before jti was added cannot be denylisted.
+	if jti, _ := claims["jti"].(string); jti != "" {
+		expiresAt, _ := claims.GetExpirationTime()
+		revoked, err := gTokenDenylist.IsRevoked(jti, expiresAt.Time)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrUnexpectedTokenValidation, err)
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
 	return &claims, nil
 }
+
+// ValidateAnyToken is for endpoints that take either kind of token, trying
+// the hinted type first. The claims are nil when neither validates; the error
+// only reports a token that could not be checked, such as when the denylist
+// is unreachable.
+func ValidateAnyToken(tokenString string, hint TokenType) (*jwt.MapClaims, TokenType, error) {
+	tokenTypes := []TokenType{Access, Refresh}
+	if hint == Refresh {
+		tokenTypes = []TokenType{Refresh, Access}
+	}
+
+	for _, tokenType := range tokenTypes {
+		claims, err := ValidateToken(tokenString, tokenType)
+		if err == nil {
+			return claims, tokenType, nil
+		} else if errors.Is(err, ErrUnexpectedTokenValidation) {
+			return nil, "", err
+		}
+	}
+	return nil, "", nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var gTrustedProxies []netip.Prefix
+
+// initTrustedProxies reads TRUSTED_PROXIES, a comma separated list of proxy
+// addresses or CIDR ranges allowed to set X-Forwarded-For.
+func initTrustedProxies() {
+	proxiesStr := os.Getenv("TRUSTED_PROXIES")
+	if proxiesStr == "" {
+		return
+	}
+
+	proxies, err := parseTrustedProxies(proxiesStr)
+	if err != nil {
+		logger.Fatal("Setup Project Error | Invalid TRUSTED_PROXIES", zap.Error(err))
+	}
+	gTrustedProxies = proxies
+}
+
+func parseTrustedProxies(proxiesStr string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+
+	for _, entry := range strings.Split(proxiesStr, ",") {
+		entry = strings.TrimSpace(entry)
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+
+	return proxies, nil
+}
+
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	for _, proxy := range gTrustedProxies {
+		if proxy.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the peer address, unless the peer is a trusted proxy. Then
+// X-Forwarded-For is read from the right, skipping the trusted hops, so a
+// client cannot choose its address by sending the header itself.
+func clientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
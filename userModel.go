@@ -1,6 +1,10 @@
 package main
 
-import "github.com/google/uuid"
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type UserStatus int8
 
@@ -26,14 +30,16 @@ type User struct {
     ID              		uuid.UUID 	`json:"id"`
     NickName        		string    	`json:"nickname"`
     Email	        		*string   	`json:"email"`
+    EmailVerified   		bool      	`json:"email_verified"`
     ImgURL          		string    	`json:"img_url"`
-	AccessToken     		*string    	`json:"access_token"`
-    RefreshToken    		*string   	`json:"refresh_token"`
+	AccessTokenHash 		*string    	`json:"-"`
+    RefreshTokenHash		*string   	`json:"-"`
 	Status					UserStatus	`json:"status"`
 	Role					UserRole	`json:"role"`
     Provider        		string    	`json:"provider"`
     ProviderUserID  		string    	`json:"provider_user_id"`
     ProviderAccessToken     string    	`json:"provider_access_token"`
     ProviderRefreshToken    *string   	`json:"provider_refresh_token"`
+    ProviderTokenExpiresAt  *time.Time	`json:"provider_token_expires_at"`
 	Terms					bool		`json:"terms_accepted"`
 }
\ No newline at end of file